@@ -0,0 +1,60 @@
+package gzip
+
+// HandlerBuilder configures a handler step by step. It collects the same
+// options as NewWithOptions, which reads better for larger configurations.
+type HandlerBuilder struct {
+	opts []Option
+}
+
+// Builder returns an empty HandlerBuilder. Built without any further calls,
+// the handler behaves like Default.
+func Builder() *HandlerBuilder {
+	return &HandlerBuilder{}
+}
+
+// With adds opts, for settings that have no method of their own.
+func (b *HandlerBuilder) With(opts ...Option) *HandlerBuilder {
+	b.opts = append(b.opts, opts...)
+	return b
+}
+
+// Level sets the compression level, see WithLevel.
+func (b *HandlerBuilder) Level(level int) *HandlerBuilder {
+	return b.With(WithLevel(level))
+}
+
+// MinSize sets MinSize.
+func (b *HandlerBuilder) MinSize(size int) *HandlerBuilder {
+	return b.With(WithMinSize(size))
+}
+
+// ExcludeTypes sets ExcludedContentTypes.
+func (b *HandlerBuilder) ExcludeTypes(types ...string) *HandlerBuilder {
+	return b.With(WithExcludedTypes(types))
+}
+
+// CompressibleTypes sets CompressibleTypes.
+func (b *HandlerBuilder) CompressibleTypes(types ...string) *HandlerBuilder {
+	return b.With(WithCompressibleTypes(types))
+}
+
+// ExcludePaths sets ExcludedPaths.
+func (b *HandlerBuilder) ExcludePaths(prefixes ...string) *HandlerBuilder {
+	return b.With(WithExcludedPaths(prefixes...))
+}
+
+// Encodings sets the encodings to negotiate, see WithEncodings.
+func (b *HandlerBuilder) Encodings(encodings ...string) *HandlerBuilder {
+	return b.With(WithEncodings(encodings...))
+}
+
+// AllowFunc sets the AllowCompressionFunc, see WithAllowFunc.
+func (b *HandlerBuilder) AllowFunc(fn AllowCompressionFunc) *HandlerBuilder {
+	return b.With(WithAllowFunc(fn))
+}
+
+// Build returns a handler with the options collected so far. The builder can
+// be used further to build more handlers.
+func (b *HandlerBuilder) Build() *handler {
+	return NewWithOptions(b.opts...)
+}
@@ -0,0 +1,50 @@
+package gzip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func Test_Builder(t *testing.T) {
+	built := Builder().
+		Level(BestSpeed).
+		MinSize(1024).
+		ExcludeTypes("image/*").
+		CompressibleTypes("text/*").
+		ExcludePaths("/metrics").
+		Encodings(encodingBrotli, encodingGzip).
+		With(WithAutoFlush(true)).
+		Build()
+
+	want := NewWithOptions(
+		WithLevel(BestSpeed),
+		WithMinSize(1024),
+		WithExcludedTypes([]string{"image/*"}),
+		WithCompressibleTypes([]string{"text/*"}),
+		WithExcludedPaths("/metrics"),
+		WithEncodings(encodingBrotli, encodingGzip),
+		WithAutoFlush(true),
+	)
+
+	if !reflect.DeepEqual(built, want) {
+		t.Errorf("Build() = %+v, want %+v", built, want)
+	}
+}
+
+func Test_Builder_AllowFunc(t *testing.T) {
+	h := Builder().AllowFunc(func(w http.ResponseWriter, r *http.Request) bool {
+		return false
+	}).Build()
+
+	if h.allowCompression == nil || h.allowCompression(httptest.NewRecorder(), nil, http.StatusOK) {
+		t.Fail()
+	}
+}
+
+func Test_Builder_Default(t *testing.T) {
+	if !reflect.DeepEqual(Builder().Build(), Default()) {
+		t.Fail()
+	}
+}
@@ -0,0 +1,40 @@
+package gzip
+
+import (
+	"context"
+)
+
+// disableKey is the context key for the flag that disables compression.
+type disableKey struct{}
+
+// compressionKey is the context key for a Compression.
+type compressionKey struct{}
+
+// WithDisabled returns a context that disables compression for the request
+// it is attached to. It can be used by a middleware in front of the handler:
+//
+//	next(w, r.WithContext(gzip.WithDisabled(r.Context())))
+//
+// or by a handler behind it, as long as the response has not been written
+// yet. The handler gives every request it wraps a context with its own flag,
+// which WithDisabled sets in place.
+func WithDisabled(ctx context.Context) context.Context {
+	if disabled, ok := ctx.Value(disableKey{}).(*bool); ok {
+		*disabled = true
+		return ctx
+	}
+	disabled := true
+	return context.WithValue(ctx, disableKey{}, &disabled)
+}
+
+// Disabled reports whether compression was disabled with WithDisabled.
+func Disabled(ctx context.Context) bool {
+	disabled, ok := ctx.Value(disableKey{}).(*bool)
+	return ok && *disabled
+}
+
+// WithCompression returns a copy of ctx carrying c. The handler consults c for
+// every request with such a context, alongside its AllowCompressionFunc.
+func WithCompression(ctx context.Context, c Compression) context.Context {
+	return context.WithValue(ctx, compressionKey{}, c)
+}
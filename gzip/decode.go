@@ -0,0 +1,44 @@
+package gzip
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ReadBody reads and closes the body of resp, decompressing it according to
+// its Content-Encoding. Bodies without a Content-Encoding are returned as
+// they are. It is meant for tests, for example with the Result of an
+// httptest.ResponseRecorder.
+func ReadBody(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+
+	var r io.Reader
+	switch encoding := strings.ToLower(resp.Header.Get(headerContentEncoding)); encoding {
+	case "", encodingIdentity:
+		r = resp.Body
+	case encodingGzip, "x-gzip":
+		gr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	case encodingDeflate:
+		zr, err := zlib.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	case encodingBrotli:
+		r = brotli.NewReader(resp.Body)
+	default:
+		return nil, fmt.Errorf("gzip: unsupported encoding: %q", encoding)
+	}
+	return io.ReadAll(r)
+}
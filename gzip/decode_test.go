@@ -0,0 +1,40 @@
+package gzip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_ReadBody(t *testing.T) {
+	for _, encoding := range []string{encodingBrotli, encodingGzip, encodingDeflate, encodingIdentity} {
+		gzipHandler := NewWithEncodings([]string{encodingBrotli, encodingGzip, encodingDeflate}, DefaultCompression)
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encoding)
+
+		gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+		body, err := ReadBody(w.Result())
+		if err != nil {
+			t.Errorf("%s: %v", encoding, err)
+		}
+		if string(body) != gzipTestString {
+			t.Errorf("%s: body = %q, want %q", encoding, body, gzipTestString)
+		}
+	}
+}
+
+func Test_ReadBody_UnsupportedEncoding(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set(headerContentEncoding, "zstd")
+	w.WriteString(gzipTestString)
+
+	if _, err := ReadBody(w.Result()); err == nil {
+		t.Error("expected an error for an unsupported encoding")
+	}
+}
@@ -0,0 +1,104 @@
+package gzip
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"io"
+	"sync"
+)
+
+const (
+	encodingBrotli  = "br"
+	encodingDeflate = "deflate"
+)
+
+// WriteFlushCloser is a compressing writer. Flush writes any pending
+// compressed data to the underlying writer, Close additionally writes the end
+// of the compressed stream.
+type WriteFlushCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// WriterFactory creates the compressing writer for a response writing to w.
+type WriterFactory func(w io.Writer) (WriteFlushCloser, error)
+
+// nopFlusher adds a Flush that does nothing to an io.WriteCloser.
+type nopFlusher struct {
+	io.WriteCloser
+}
+
+func (nopFlusher) Flush() error {
+	return nil
+}
+
+// encoder is a built-in compressing writer for a single Content-Encoding. It
+// can be Reset to write to another writer, which allows pooling.
+type encoder interface {
+	WriteFlushCloser
+	Reset(w io.Writer)
+}
+
+// newEncoder returns an encoder for the given Content-Encoding writing to w.
+// The level is passed on as it is, except that DefaultCompression maps to the
+// default of the chosen encoding.
+func newEncoder(encoding string, w io.Writer, level int) (encoder, error) {
+	switch encoding {
+	case encodingBrotli:
+		if level == gzip.DefaultCompression {
+			level = brotli.DefaultCompression
+		}
+		if level < brotli.BestSpeed || level > brotli.BestCompression {
+			return nil, fmt.Errorf("gzip: invalid brotli compression level: %d", level)
+		}
+		return brotli.NewWriterLevel(w, level), nil
+	case encodingGzip:
+		gz, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		return gz, nil
+	case encodingDeflate:
+		// The deflate coding is a zlib stream, not raw deflate.
+		zw, err := zlib.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		return zw, nil
+	default:
+		return nil, fmt.Errorf("gzip: unsupported encoding: %q", encoding)
+	}
+}
+
+// encoderPools recycles encoders between requests. An encoder keeps the level
+// it was created with across Reset, so there is a separate pool for each
+// encoding and level.
+type encoderPools struct {
+	pools sync.Map // poolKey -> *sync.Pool
+}
+
+type poolKey struct {
+	encoding string
+	level    int
+}
+
+// get returns a pooled encoder reset to write to w, or a new one if the pool is
+// empty.
+func (p *encoderPools) get(encoding string, w io.Writer, level int) (encoder, error) {
+	if pool, ok := p.pools.Load(poolKey{encoding, level}); ok {
+		if enc, ok := pool.(*sync.Pool).Get().(encoder); ok {
+			enc.Reset(w)
+			return enc, nil
+		}
+	}
+	return newEncoder(encoding, w, level)
+}
+
+// put returns enc to the pool for its encoding and level. The encoder must
+// either be closed or not have been written to.
+func (p *encoderPools) put(encoding string, level int, enc encoder) {
+	pool, _ := p.pools.LoadOrStore(poolKey{encoding, level}, &sync.Pool{})
+	pool.(*sync.Pool).Put(enc)
+}
@@ -0,0 +1,45 @@
+package gzip
+
+import (
+	"math"
+)
+
+// mediaTypeOctetStream is the media type of arbitrary binary data, and what
+// http.DetectContentType returns for a body it doesn't recognize.
+const mediaTypeOctetStream = "application/octet-stream"
+
+// Bounds of the sample looksCompressible considers.
+const (
+	minEntropySample = 32
+	maxEntropySample = sniffLen
+)
+
+// looksCompressible estimates from the Shannon entropy of the start of a body
+// whether compressing it is worthwhile. Already compressed or encrypted data
+// is close to random, which uses nearly the maximum entropy a sample of its
+// size can have. Samples too short to tell are assumed to be compressible.
+func looksCompressible(b []byte) bool {
+	if len(b) > maxEntropySample {
+		b = b[:maxEntropySample]
+	}
+	if len(b) < minEntropySample {
+		return true
+	}
+
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	n := float64(len(b))
+	entropy := 0.0
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / n
+			entropy -= p * math.Log2(p)
+		}
+	}
+
+	// A sample of n bytes has at most log2(n) bits of entropy per byte, up
+	// to 8 once every byte value can occur.
+	return entropy < 0.9*math.Log2(math.Min(n, 256))
+}
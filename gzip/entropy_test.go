@@ -0,0 +1,31 @@
+package gzip
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func Test_looksCompressible(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"random", random, false},
+		{"short random", random[:64], false},
+		{"too short to tell", random[:minEntropySample-1], true},
+		{"text", []byte(strings.Repeat(gzipTestString+" ", 50)), true},
+		{"json", []byte(`{"id":1,"name":"Foobar Wibble","tags":["a","b","c"],"nested":{"enabled":true,"count":42}}`), true},
+		{"zeros", make([]byte, 1024), true},
+	}
+
+	for _, test := range tests {
+		if got := looksCompressible(test.b); got != test.want {
+			t.Errorf("looksCompressible(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package gzip
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment variables read by NewFromEnv.
+const (
+	envLevel        = "GZIP_LEVEL"
+	envMinSize      = "GZIP_MIN_SIZE"
+	envExcludeTypes = "GZIP_EXCLUDE_TYPES"
+)
+
+// NewFromEnv returns a handler configured from environment variables, for
+// deployments that are configured that way:
+//
+//	GZIP_LEVEL          the compression level, see WithLevel
+//	GZIP_MIN_SIZE       MinSize in bytes
+//	GZIP_EXCLUDE_TYPES  a comma separated ExcludedContentTypes list
+//
+// Unset or empty variables keep the defaults of Default. It returns an error
+// if a value can't be parsed or the level is invalid.
+func NewFromEnv() (*handler, error) {
+	var opts []Option
+
+	if value := os.Getenv(envLevel); value != "" {
+		level, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("gzip: invalid %s %q: %w", envLevel, value, err)
+		}
+		opts = append(opts, WithLevel(level))
+	}
+
+	if value := os.Getenv(envMinSize); value != "" {
+		size, err := strconv.Atoi(strings.TrimSpace(value))
+		if err == nil && size < 0 {
+			err = errors.New("must not be negative")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("gzip: invalid %s %q: %w", envMinSize, value, err)
+		}
+		opts = append(opts, WithMinSize(size))
+	}
+
+	if value := os.Getenv(envExcludeTypes); value != "" {
+		var types []string
+		for _, typ := range strings.Split(value, ",") {
+			if typ = strings.TrimSpace(typ); typ != "" {
+				types = append(types, typ)
+			}
+		}
+		opts = append(opts, WithExcludedTypes(types))
+	}
+
+	h := NewWithOptions(opts...)
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
@@ -0,0 +1,56 @@
+package gzip
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_NewFromEnv(t *testing.T) {
+	t.Setenv(envLevel, "1")
+	t.Setenv(envMinSize, "1024")
+	t.Setenv(envExcludeTypes, "image/*, application/pdf,")
+
+	h, err := NewFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.compressionLevel != BestSpeed {
+		t.Errorf("level = %d, want %d", h.compressionLevel, BestSpeed)
+	}
+	if h.MinSize != 1024 {
+		t.Errorf("MinSize = %d, want 1024", h.MinSize)
+	}
+	if want := []string{"image/*", "application/pdf"}; !reflect.DeepEqual(h.ExcludedContentTypes, want) {
+		t.Errorf("ExcludedContentTypes = %v, want %v", h.ExcludedContentTypes, want)
+	}
+}
+
+func Test_NewFromEnv_Defaults(t *testing.T) {
+	t.Setenv(envLevel, "")
+	t.Setenv(envMinSize, "")
+	t.Setenv(envExcludeTypes, "")
+
+	h, err := NewFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h, Default()) {
+		t.Errorf("NewFromEnv() = %+v, want Default()", h)
+	}
+}
+
+func Test_NewFromEnv_Invalid(t *testing.T) {
+	for name, env := range map[string][2]string{
+		"level out of range": {envLevel, "10"},
+		"level not a number": {envLevel, "best"},
+		"negative min size":  {envMinSize, "-1"},
+		"min size not int":   {envMinSize, "1k"},
+	} {
+		t.Setenv(envLevel, "")
+		t.Setenv(envMinSize, "")
+		t.Setenv(env[0], env[1])
+		if _, err := NewFromEnv(); err == nil {
+			t.Errorf("%s: %s=%q was accepted", name, env[0], env[1])
+		}
+	}
+}
@@ -2,22 +2,51 @@
 package gzip
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
 	"github.com/codegangsta/negroni"
+	"io"
+	"net"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // These compression constants are copied from the compress/gzip package.
 const (
 	encodingGzip = "gzip"
 
-	headerAcceptEncoding  = "Accept-Encoding"
-	headerContentEncoding = "Content-Encoding"
-	headerContentLength   = "Content-Length"
-	headerContentType     = "Content-Type"
-	headerVary            = "Vary"
-	headerSecWebSocketKey = "Sec-WebSocket-Key"
+	headerAcceptEncoding   = "Accept-Encoding"
+	headerAcceptRanges     = "Accept-Ranges"
+	headerCacheControl     = "Cache-Control"
+	headerContentEncoding  = "Content-Encoding"
+	headerContentLength    = "Content-Length"
+	headerContentRange     = "Content-Range"
+	headerContentType      = "Content-Type"
+	headerETag             = "ETag"
+	headerRange            = "Range"
+	headerVary             = "Vary"
+	headerSecWebSocketKey  = "Sec-WebSocket-Key"
+	headerTransferEncoding = "Transfer-Encoding"
+	headerGzipSkipped      = "X-Gzip-Skipped"
+	headerConnection       = "Connection"
+	headerUpgrade          = "Upgrade"
+
+	// sniffLen is the number of bytes http.DetectContentType considers.
+	sniffLen = 512
+
+	// defaultBufferCompressedSize is the BufferCompressedSize used when none
+	// is configured.
+	defaultBufferCompressedSize = 32 << 10
+
+	// defaultCoalesceSize is the CoalesceSize used when none is configured.
+	defaultCoalesceSize = 32 << 10
 
 	BestCompression    = gzip.BestCompression
 	BestSpeed          = gzip.BestSpeed
@@ -25,6 +54,24 @@ const (
 	NoCompression      = gzip.NoCompression
 )
 
+// ErrWriteAfterClose is returned by writes to a ResponseWriter after the
+// handler it was passed to returned.
+var ErrWriteAfterClose = errors.New("gzip: write after the handler returned")
+
+// ErrMaxBytes is returned by Write once a compressed response reached the
+// handler's MaxBytes.
+var ErrMaxBytes = errors.New("gzip: compressed response exceeds MaxBytes")
+
+// ErrAborted is returned by writes to a ResponseWriter after Abort.
+var ErrAborted = errors.New("gzip: response was aborted")
+
+// errCompressionDecided is returned by SetCompression once the compression
+// decision was made.
+var errCompressionDecided = errors.New("gzip: compression was already decided")
+
+// errHijackCompressed is returned by Hijack once compressed output has started.
+var errHijackCompressed = errors.New("gzip: cannot hijack a compressed response")
+
 type status int
 
 const (
@@ -33,65 +80,1462 @@ const (
 	COMPRESSION_ENABLED
 )
 
+// String returns "check", "disabled" or "enabled".
+func (s status) String() string {
+	switch s {
+	case COMPRESSION_CHECK:
+		return "check"
+	case COMPRESSION_DISABLED:
+		return "disabled"
+	case COMPRESSION_ENABLED:
+		return "enabled"
+	}
+	return "status(" + strconv.Itoa(int(s)) + ")"
+}
+
 // gzipResponseWriter is the ResponseWriter that negroni.ResponseWriter is
 // wrapped in.
 type gzipResponseWriter struct {
-	r *http.Request
-	w *gzip.Writer
+	r        *http.Request
+	w        WriteFlushCloser
+	encoding string
+	level    int
 	negroni.ResponseWriter
+	original         http.ResponseWriter // what the middleware was passed
 	status           status
-	allowCompression AllowCompressionFunc
+	allowCompression AllowCompressionFuncWithStatus
+	h                *handler
+	code             int
+	peek             peekWriter
+	uncompressed     int64
+	base             int   // Size of the ResponseWriter when it was wrapped
+	copied           int64 // body bytes written past the ResponseWriter
+	produced         int64 // compressed bytes, counted for MaxBytes
+	unflushed        int
+	compressed       *bytes.Buffer
+	coalesced        *bufio.Writer
+	closed           bool
+	aborted          bool
+	override         status
+	gzipHeader       gzip.Header
+	incompressible   bool
+	err              error
+	reason           string // why the response is passed through
+	mu               sync.Mutex
 }
 
 type AllowCompressionFunc func(w http.ResponseWriter, r *http.Request) bool
 
+// AllowCompressionFuncWithStatus is an AllowCompressionFunc that is also
+// passed the status code of the response, for example to leave error pages
+// uncompressed.
+type AllowCompressionFuncWithStatus func(w http.ResponseWriter, r *http.Request, code int) bool
+
+// WithStatus adapts fn to an AllowCompressionFuncWithStatus that ignores the
+// status code. A nil fn stays nil.
+func (fn AllowCompressionFunc) WithStatus() AllowCompressionFuncWithStatus {
+	if fn == nil {
+		return nil
+	}
+	return func(w http.ResponseWriter, r *http.Request, code int) bool {
+		return fn(w, r)
+	}
+}
+
+// AllowCompressionFuncE is an AllowCompressionFunc whose decision can fail.
+// An error replaces the response with a 500 Internal Server Error, is
+// returned from the handler's writes and is passed to OnError.
+type AllowCompressionFuncE func(w http.ResponseWriter, r *http.Request) (bool, error)
+
+// Compression can be attached to a request with WithCompression to take part
+// in the compression decision. It is consulted after the AllowCompressionFunc
+// and only if that allowed compression, so both have to agree for the
+// response to be compressed.
 type Compression interface {
 	AllowCompression(w http.ResponseWriter, r *http.Request) bool
 }
 
+// WriteHeader records the status code. For a status that can carry a body the
+// compression decision is postponed until the body starts, so the status
+// code is held back until then and a response that turns out empty is sent
+// without Content-Encoding. Other status codes are written right away. Only
+// the first call has an effect, later ones and those after the body started
+// are ignored unless ResetOnRewrite is set. Informational status codes such
+// as 103 Early Hints are sent right away and don't count as that call, the
+// final status code follows them.
 func (grw *gzipResponseWriter) WriteHeader(code int) {
+	grw.lock()
+	defer grw.unlock()
+	if grw.closed || grw.aborted {
+		return
+	}
+	// A write without WriteHeader starts the response with an implicit 200.
+	started := grw.code != 0 || grw.peek.len() > 0
+	if informational(code) && !started {
+		grw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if started {
+		if !grw.h.ResetOnRewrite || grw.status != COMPRESSION_CHECK {
+			return
+		}
+		// Nothing was sent yet, so the response can start over.
+		grw.peek.reset()
+		grw.uncompressed = 0
+	}
 	if grw.status == COMPRESSION_CHECK {
-		if grw.allowCompression == nil || grw.allowCompression(grw, grw.r) {
-			grw.status = COMPRESSION_ENABLED
-			headers := grw.Header()
-			// Delete any existing content length header.
-			// see http://stackoverflow.com/questions/3819280/content-length-when-using-http-compression
-			headers.Del(headerContentLength)
-			// Set the appropriate gzip headers.
-			headers.Set(headerContentEncoding, encodingGzip)
-			headers.Set(headerVary, headerAcceptEncoding)
-		} else {
-			grw.status = COMPRESSION_DISABLED
+		grw.code = code
+		if bodyAllowed(code) {
+			return
 		}
+		compress, _ := grw.settle(0)
+		grw.writeHeader(compress)
+		return
 	}
+	grw.code = code
 	grw.ResponseWriter.WriteHeader(code)
 }
 
-// Write writes bytes to the gzip.Writer. It will also set the Content-Type
+// newResponseWriter returns a gzipResponseWriter that writes the response to
+// r through nrw, compressing with encoding when compression is enabled. w is
+// the ResponseWriter the middleware was passed, which nrw wraps or is. A
+// gzipResponseWriter is only valid until the handler it was passed to
+// returns, writes after that fail with ErrWriteAfterClose. It is never reused
+// for another request, so a goroutine that outlives the handler can't write
+// into someone else's response.
+func newResponseWriter(h *handler, w http.ResponseWriter, nrw negroni.ResponseWriter, r *http.Request, encoding string) *gzipResponseWriter {
+	return &gzipResponseWriter{
+		r:                r,
+		encoding:         encoding,
+		ResponseWriter:   nrw,
+		original:         w,
+		base:             nrw.Size(),
+		allowCompression: h.allowCompression,
+		status:           COMPRESSION_CHECK,
+		h:                h,
+	}
+}
+
+// Status returns the status code of the response, including one that is held
+// back while the compression decision is pending, or 0 if none was written.
+func (grw *gzipResponseWriter) Status() int {
+	grw.lock()
+	defer grw.unlock()
+	return grw.code
+}
+
+// Written reports whether the status code was written, like Status it
+// includes one that is held back while the compression decision is pending.
+// It overrides the Written of the underlying negroni.ResponseWriter, which
+// only learns of the status code once it was sent.
+func (grw *gzipResponseWriter) Written() bool {
+	grw.lock()
+	defer grw.unlock()
+	return grw.code != 0
+}
+
+// BytesWritten returns the number of body bytes written to the underlying
+// ResponseWriter so far, compressed or not. Bytes still held back by the
+// compressing writer or while the compression decision is pending are not
+// included. It is named apart from Written, which negroni.ResponseWriter
+// already defines.
+func (grw *gzipResponseWriter) BytesWritten() int64 {
+	grw.lock()
+	defer grw.unlock()
+	return grw.bytesWritten()
+}
+
+// bytesWritten implements BytesWritten, the caller holds the lock.
+func (grw *gzipResponseWriter) bytesWritten() int64 {
+	return int64(grw.ResponseWriter.Size()-grw.base) + grw.copied
+}
+
+// CompressionState returns the compression decision for the response:
+// "enabled" or "disabled" once it was made, and "check" while it is pending.
+func (grw *gzipResponseWriter) CompressionState() string {
+	grw.lock()
+	defer grw.unlock()
+	return grw.status.String()
+}
+
+// WasCompressed reports whether the response written to w is compressed. For
+// a ResponseWriter wrapped by this middleware that is decided by the
+// middleware itself, otherwise the Content-Encoding header is checked.
+//
+// The decision is only made once the status code or enough of the body was
+// written, until then WasCompressed reports false.
+func WasCompressed(w http.ResponseWriter) bool {
+	if grw, ok := w.(*gzipResponseWriter); ok {
+		grw.lock()
+		defer grw.unlock()
+		return grw.status == COMPRESSION_ENABLED
+	}
+	encoding := w.Header().Get(headerContentEncoding)
+	return encoding != "" && encoding != encodingIdentity
+}
+
+// SetCompression lets the handler decide whether the response is compressed.
+// Enabling it overrides the MinSize, the content type lists and the allow
+// funcs, but not the checks that keep a response correct: responses without
+// a body, partial content, bodies that are already encoded and responses
+// marked no-transform are never compressed, and neither are those excluded
+// by the handler's status and header settings. It has to be called before
+// the decision is made, which happens at the latest with the first bytes sent
+// to the client. After that it returns an error, as the compressed stream, or
+// the raw body, has begun.
+//
+// Handlers reach it with a type assertion:
+//
+//	if c, ok := w.(interface{ SetCompression(bool) error }); ok {
+//		c.SetCompression(false)
+//	}
+func (grw *gzipResponseWriter) SetCompression(enabled bool) error {
+	grw.lock()
+	defer grw.unlock()
+	if grw.status != COMPRESSION_CHECK || grw.closed {
+		return errCompressionDecided
+	}
+	grw.override = COMPRESSION_DISABLED
+	if enabled {
+		grw.override = COMPRESSION_ENABLED
+	}
+	return nil
+}
+
+// SetGzipName sets the Name field of the gzip header, the file name gunzip
+// restores the body under, for download endpoints. Like SetCompression it has
+// to be called before the compression decision is made and returns an error
+// after that. It has no effect unless the response ends up compressed with
+// gzip. The name must be representable in Latin-1 and not contain NUL bytes,
+// otherwise writing the compressed stream fails.
+func (grw *gzipResponseWriter) SetGzipName(name string) error {
+	grw.lock()
+	defer grw.unlock()
+	if grw.status != COMPRESSION_CHECK || grw.closed {
+		return errCompressionDecided
+	}
+	grw.gzipHeader.Name = name
+	return nil
+}
+
+// SetGzipComment is SetGzipName for the Comment field of the gzip header.
+func (grw *gzipResponseWriter) SetGzipComment(comment string) error {
+	grw.lock()
+	defer grw.unlock()
+	if grw.status != COMPRESSION_CHECK || grw.closed {
+		return errCompressionDecided
+	}
+	grw.gzipHeader.Comment = comment
+	return nil
+}
+
+// checkSize compares the size of the body with the MinSize. It reports whether
+// the body is large enough to be compressed, and whether that is known yet.
+// It is known without a MinSize, or if the handler set a Content-Length.
+// Otherwise the body has to be buffered until it reaches the MinSize.
+func (grw *gzipResponseWriter) checkSize() (large, known bool) {
+	if grw.reason != "" {
+		// The response is passed through whatever its size.
+		return false, true
+	}
+	if grw.override != COMPRESSION_CHECK {
+		return grw.override == COMPRESSION_ENABLED, true
+	}
+	if grw.h.MinSize <= 0 {
+		return true, true
+	}
+	size, err := strconv.ParseInt(grw.Header().Get(headerContentLength), 10, 64)
+	if err != nil {
+		return false, false
+	}
+	return size >= int64(grw.h.MinSize), true
+}
+
+// settle reports whether the compression decision can be made once n bytes
+// of the body were written, and if so whether the body is large enough to be
+// compressed. That needs the size compared with the MinSize and, without a
+// Content-Type from the handler, the full sniffing window to detect it.
+func (grw *gzipResponseWriter) settle(n int) (compress, ok bool) {
+	large, known := grw.checkSize()
+	if !known {
+		// With PeekFirstWrite, another write after the first means the
+		// body is streamed.
+		large = n >= grw.h.MinSize || (grw.h.PeekFirstWrite && grw.peek.writes > 0)
+	}
+	if n < sniffLen && len(grw.Header().Get(headerContentType)) == 0 {
+		return large, false
+	}
+	return large, known || large
+}
+
+// writeHeader settles the compression decision and writes the pending status
+// code to the underlying ResponseWriter. Compression is only considered if
+// compress is true.
+func (grw *gzipResponseWriter) writeHeader(compress bool) {
+	if grw.code == 0 {
+		grw.code = http.StatusOK
+	}
+	if reason := grw.skipReason(compress); reason != "" {
+		grw.status = COMPRESSION_DISABLED
+		grw.h.skip(grw, grw.r, reason)
+		if grw.err != nil {
+			grw.fail()
+			return
+		}
+	} else {
+		grw.status = COMPRESSION_ENABLED
+		grw.h.enable(grw.r, grw.encoding)
+		headers := grw.Header()
+		// Delete any existing content length header.
+		// see http://stackoverflow.com/questions/3819280/content-length-when-using-http-compression
+		headers.Del(headerContentLength)
+		// Set the appropriate gzip headers.
+		headers.Set(headerContentEncoding, grw.encoding)
+		grw.h.vary(headers)
+		// A strong ETag no longer matches the bytes on the wire, so make it
+		// weak.
+		if etag := headers.Get(headerETag); strings.HasPrefix(etag, `"`) {
+			headers.Set(headerETag, "W/"+etag)
+		}
+		if grw.h.StripAcceptRanges {
+			headers.Del(headerAcceptRanges)
+		}
+	}
+	// A buffered compressed body is sent with the status code once its
+	// length is known.
+	if grw.compressed == nil {
+		grw.ResponseWriter.WriteHeader(grw.code)
+	}
+}
+
+// fail replaces the response with a 500 Internal Server Error after the
+// AllowCompressionFuncE failed. The handler's headers are dropped, and its
+// body is rejected by write.
+func (grw *gzipResponseWriter) fail() {
+	headers := grw.Header()
+	for name := range headers {
+		delete(headers, name)
+	}
+	grw.code = http.StatusInternalServerError
+	http.Error(grw.ResponseWriter, http.StatusText(grw.code), grw.code)
+}
+
+// newWriter creates the compressing writer once compression is enabled, at
+// the level chosen by the LevelFunc. It reports false if that failed, for
+// example because the level is invalid. With BufferCompressed the writer
+// compresses into a buffer first, with CoalesceWrites its output is
+// collected into larger writes.
+func (grw *gzipResponseWriter) newWriter() bool {
+	grw.level = grw.h.compressionLevel
+	if grw.h.LevelFunc != nil {
+		grw.level = grw.h.LevelFunc(grw, grw.r)
+	}
+	var dst io.Writer = grw.ResponseWriter
+	if grw.h.BufferCompressed {
+		dst = writerFunc(grw.writeCompressed)
+	}
+	if grw.h.CoalesceWrites {
+		grw.coalesced = grw.h.getCoalescer(dst)
+		dst = grw.coalesced
+	}
+	if grw.h.MaxBytes > 0 {
+		// Count the output before the buffers above hold it back.
+		next := dst
+		dst = writerFunc(func(b []byte) (int, error) {
+			n, err := next.Write(b)
+			grw.produced += int64(n)
+			return n, err
+		})
+	}
+	w, err := grw.h.newWriter(grw.encoding, dst, grw.level)
+	if err != nil {
+		return false
+	}
+	if gz, ok := w.(*gzip.Writer); ok {
+		if grw.gzipHeader.Name != "" {
+			gz.Name = grw.gzipHeader.Name
+		}
+		if grw.gzipHeader.Comment != "" {
+			gz.Comment = grw.gzipHeader.Comment
+		}
+	}
+	grw.w = w
+	if grw.h.BufferCompressed {
+		grw.compressed = &bytes.Buffer{}
+	}
+	return true
+}
+
+// writeCompressed receives the output of the compressing writer when
+// BufferCompressed is set. It is kept in memory until it outgrows the
+// BufferCompressedSize and then sent on.
+func (grw *gzipResponseWriter) writeCompressed(b []byte) (int, error) {
+	if grw.compressed == nil {
+		return grw.ResponseWriter.Write(b)
+	}
+	grw.compressed.Write(b)
+	if grw.compressed.Len() > grw.h.bufferCompressedSize() {
+		if err := grw.sendCompressed(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// sendCompressed writes the status code and the buffered compressed body to
+// the underlying ResponseWriter, after which compressed output is streamed.
+func (grw *gzipResponseWriter) sendCompressed() error {
+	buf := grw.compressed
+	grw.compressed = nil
+	grw.ResponseWriter.WriteHeader(grw.code)
+	_, err := grw.ResponseWriter.Write(buf.Bytes())
+	return err
+}
+
+// informational reports whether code is a 1xx status that precedes the final
+// response. 101 Switching Protocols ends the response instead.
+func informational(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
+// DefaultShouldCompressStatus compresses responses of every status except
+// redirects and other 3xx responses, whose bodies are at most a short note
+// that isn't worth compressing.
+func DefaultShouldCompressStatus(code int) bool {
+	return code < http.StatusMultipleChoices || code >= http.StatusBadRequest
+}
+
+// only2xx is the ShouldCompressStatus set by WithOnly2xx. It compresses
+// successful responses only, leaving redirects and error pages uncompressed.
+func only2xx(code int) bool {
+	return code >= http.StatusOK && code < http.StatusMultipleChoices
+}
+
+// bodyAllowed reports whether a response with the status code can carry a
+// body. Informational, 204 No Content and 304 Not Modified responses can't,
+// so there is nothing to compress.
+func bodyAllowed(code int) bool {
+	return code >= http.StatusOK && code != http.StatusNoContent && code != http.StatusNotModified
+}
+
+// skipReason returns why the response is not compressed, or an empty string
+// if it is. It decides based on the body size, status, headers and the
+// AllowCompressionFunc, and creates the compressing writer once everything
+// agreed.
+func (grw *gzipResponseWriter) skipReason(large bool) string {
+	if grw.reason != "" {
+		return grw.reason
+	}
+	if grw.override == COMPRESSION_DISABLED {
+		return "disabled by the handler"
+	}
+	if !large {
+		// Once the handler returned the whole body was counted.
+		if grw.closed && grw.uncompressed == 0 {
+			return "empty body"
+		}
+		return "body below minimum size"
+	}
+	if !grw.h.shouldCompressStatus(grw.code) {
+		return "status excluded"
+	}
+	if reason := grw.disallowReason(); reason != "" {
+		return reason
+	}
+	if !grw.newWriter() {
+		return "creating the compressing writer failed"
+	}
+	return ""
+}
+
+// disallowReason returns why the response may not be compressed based on its
+// status, headers and the AllowCompressionFunc, or an empty string if it may.
+func (grw *gzipResponseWriter) disallowReason() string {
+	// The request may have opted out after it was wrapped.
+	if Disabled(grw.r.Context()) {
+		return "disabled for the request"
+	}
+
+	// Compressing a partial response would make its byte range meaningless.
+	// Accept-Ranges alone is not checked, file servers send it on every
+	// response.
+	if grw.code == http.StatusPartialContent || grw.Header().Get(headerContentRange) != "" {
+		return "partial content"
+	}
+
+	// A body the handler already encoded, such as a precompressed file,
+	// would be encoded twice.
+	if encoding := grw.Header().Get(headerContentEncoding); encoding != "" && encoding != encodingIdentity {
+		return "already encoded"
+	}
+
+	// Compressing is a transformation, which the response forbids.
+	if hasToken(grw.Header(), headerCacheControl, "no-transform") {
+		return "no-transform"
+	}
+	if grw.h.CacheableOnly && !cacheable(grw.Header()) {
+		return "not cacheable"
+	}
+	if grw.h.SkipTransferEncoding && grw.Header().Get(headerTransferEncoding) != "" {
+		return "Transfer-Encoding set"
+	}
+
+	// The checks below decide whether the response is worth compressing,
+	// which the handler can decide itself with SetCompression.
+	if grw.override == COMPRESSION_ENABLED {
+		return ""
+	}
+
+	// The more specific match of the allow and deny lists wins, a tie
+	// disables compression.
+	contentType := grw.Header().Get(headerContentType)
+	compressible := noMatch
+	if grw.h.CompressibleTypes != nil {
+		compressible = matchMediaType(contentType, grw.h.CompressibleTypes)
+		if compressible == noMatch {
+			return "content type not compressible"
+		}
+	}
+	if excluded := matchMediaType(contentType, grw.h.excludedContentTypes()); excluded != noMatch && excluded >= compressible {
+		return "content type excluded"
+	}
+	if !grw.h.CompressEventStreams && mediaType(contentType) == mediaTypeEventStream {
+		return "event stream"
+	}
+	if grw.incompressible {
+		return "body looks incompressible"
+	}
+	if grw.allowCompression != nil && !grw.allowCompression(grw, grw.r, grw.code) {
+		return "AllowCompressionFunc returned false"
+	}
+	if grw.h.allowCompressionE != nil {
+		allow, err := grw.h.allowCompressionE(grw, grw.r)
+		if err != nil {
+			grw.err = err
+			return "AllowCompressionFuncE failed"
+		}
+		if !allow {
+			return "AllowCompressionFuncE returned false"
+		}
+	}
+	if c, ok := grw.r.Context().Value(compressionKey{}).(Compression); ok && !c.AllowCompression(grw, grw.r) {
+		return "Compression returned false"
+	}
+	return ""
+}
+
+// Write writes bytes to the compressing writer. It will also set the Content-Type
 // header using the net/http library content type detection if the Content-Type
 // header was not set yet.
+//
+// When a minimum size is configured, writes are buffered until the body
+// reaches that size. Only then is the compression decision made and the
+// buffered bytes are written out.
+//
+// With AutoFlush, and for streaming types such as text/event-stream and
+// application/x-ndjson, every write is flushed to the client.
 func (grw *gzipResponseWriter) Write(b []byte) (int, error) {
+	grw.lock()
+	defer grw.unlock()
+	return grw.writeFlush(b)
+}
+
+// writeFlush implements Write, the caller holds the lock.
+func (grw *gzipResponseWriter) writeFlush(b []byte) (int, error) {
+	if grw.closed {
+		return 0, ErrWriteAfterClose
+	}
+	if grw.err != nil {
+		return 0, grw.err
+	}
+	if grw.status == COMPRESSION_ENABLED && grw.h.MaxBytes > 0 && grw.produced >= grw.h.MaxBytes {
+		return 0, ErrMaxBytes
+	}
+	n, err := grw.writeBody(b)
+	if grw.status == COMPRESSION_ENABLED {
+		grw.unflushed += n
+	}
+	if err == nil && grw.autoFlush() {
+		grw.flush()
+	}
+	return n, err
+}
+
+// WriteString is like Write but takes a string. Once compression is disabled
+// the string is passed on to the ResponseWriter the middleware was passed,
+// which avoids copying it if that implements io.StringWriter. Otherwise it is
+// written like with Write.
+func (grw *gzipResponseWriter) WriteString(s string) (int, error) {
+	grw.lock()
+	defer grw.unlock()
+	if grw.status != COMPRESSION_DISABLED || grw.closed || grw.err != nil {
+		return grw.writeFlush([]byte(s))
+	}
+
+	var n int
+	var err error
+	if sw, ok := grw.original.(io.StringWriter); ok && grw.original != http.ResponseWriter(grw.ResponseWriter) {
+		// The negroni.ResponseWriter has no WriteString, so it is
+		// bypassed like in ReadFrom.
+		n, err = sw.WriteString(s)
+		grw.copied += int64(n)
+	} else {
+		n, err = io.WriteString(grw.ResponseWriter, s)
+	}
+	grw.uncompressed += int64(n)
+	if err == nil && n < len(s) {
+		err = io.ErrShortWrite
+	}
+	if err == nil && grw.autoFlush() {
+		grw.flush()
+	}
+	return n, err
+}
+
+// autoFlush reports whether the last write should be flushed, because every
+// write is or because the FlushThreshold was reached.
+func (grw *gzipResponseWriter) autoFlush() bool {
+	if grw.h.FlushThreshold > 0 && grw.unflushed >= grw.h.FlushThreshold {
+		return true
+	}
+	return grw.h.AutoFlush || matchMediaType(grw.Header().Get(headerContentType), streamingMediaTypes) == exactMatch
+}
+
+// writeBody implements Write without flushing.
+func (grw *gzipResponseWriter) writeBody(b []byte) (int, error) {
+	if grw.status == COMPRESSION_CHECK && len(b) == 0 {
+		// An empty write doesn't start the body.
+		return 0, nil
+	}
 	if grw.status == COMPRESSION_CHECK {
-		if len(grw.Header().Get(headerContentType)) == 0 {
-			// Ensure Content-Type detection runs on uncompressed data.
-			// Otherwise Content-Type is set it to application/x-gzip.
-			grw.Header().Set(headerContentType, http.DetectContentType(b))
+		compress, ok := grw.settle(grw.peek.len() + len(b))
+		if !ok || grw.peek.len() > 0 {
+			grw.peek.write(grw.h, b)
+			if ok {
+				if err := grw.commit(compress); err != nil {
+					return 0, err
+				}
+			}
+			grw.uncompressed += int64(len(b))
+			return len(b), nil
+		}
+		grw.detectContentType(b)
+		grw.writeHeader(compress)
+	}
+
+	n, err := grw.write(b)
+	grw.uncompressed += int64(n)
+	return n, err
+}
+
+// detectContentType sets the Content-Type header from b if the handler did not
+// set one, using the handler's DetectContentType or http.DetectContentType.
+// With SniffCompressibility, b is also sampled for a body of unknown type.
+func (grw *gzipResponseWriter) detectContentType(b []byte) {
+	if len(grw.Header().Get(headerContentType)) == 0 {
+		// Ensure Content-Type detection runs on uncompressed data.
+		// Otherwise Content-Type is set it to application/x-gzip.
+		detect := http.DetectContentType
+		if grw.h.DetectContentType != nil {
+			detect = grw.h.DetectContentType
 		}
-		grw.WriteHeader(http.StatusOK)
+		grw.Header().Set(headerContentType, detect(b))
+	}
+	if grw.h.SniffCompressibility && mediaType(grw.Header().Get(headerContentType)) == mediaTypeOctetStream {
+		grw.incompressible = !looksCompressible(b)
 	}
+}
 
+// write sends b to the compressing writer or the underlying ResponseWriter
+// depending on the compression decision. Like any io.Writer it returns an
+// error if it consumed less than len(b) bytes, so a short count from either
+// writer is reported as io.ErrShortWrite.
+func (grw *gzipResponseWriter) write(b []byte) (n int, err error) {
+	if grw.err != nil {
+		return 0, grw.err
+	}
 	if grw.status == COMPRESSION_ENABLED {
-		return grw.w.Write(b)
+		n, err = grw.w.Write(b)
 	} else {
-		return grw.ResponseWriter.Write(b)
+		n, err = grw.ResponseWriter.Write(b)
+	}
+	if err == nil && n < len(b) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// ReadFrom copies r to the response. The first bytes go through Write, so
+// Content-Type detection and the compression decision happen as usual. After
+// that the rest of r is copied to the compressing writer, or straight to the
+// ResponseWriter the middleware was passed so that its own ReadFrom can be
+// used.
+func (grw *gzipResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if grw.h.ThreadSafe {
+		// Every write has to take the lock.
+		return io.Copy(writerFunc(grw.Write), r)
+	}
+	if grw.closed {
+		return 0, ErrWriteAfterClose
+	}
+	if grw.err != nil {
+		return 0, grw.err
+	}
+
+	var n int64
+	if grw.status == COMPRESSION_CHECK {
+		buf := make([]byte, sniffLen)
+		for grw.status == COMPRESSION_CHECK {
+			m, err := r.Read(buf)
+			if m > 0 {
+				m, err := grw.Write(buf[:m])
+				n += int64(m)
+				if err != nil {
+					return n, err
+				}
+			}
+			if err == io.EOF {
+				return n, nil
+			}
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+
+	if grw.status == COMPRESSION_ENABLED {
+		// The compressing writer has no ReadFrom of its own.
+		m, err := io.Copy(writerFunc(grw.Write), r)
+		return n + m, err
+	}
+	if grw.original != http.ResponseWriter(grw.ResponseWriter) {
+		// The negroni.ResponseWriter the middleware wrapped the original
+		// in has no ReadFrom, so it is bypassed. The status code was
+		// written through it already.
+		m, err := io.Copy(grw.original, r)
+		grw.uncompressed += m
+		grw.copied += m
+		return n + m, err
+	}
+	m, err := io.Copy(grw.ResponseWriter, r)
+	grw.uncompressed += m
+	return n + m, err
+}
+
+// writerFunc turns a function into an io.Writer.
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+// commit settles the compression decision for a response that is still being
+// checked and writes out any buffered body.
+func (grw *gzipResponseWriter) commit(compress bool) error {
+	buf := grw.peek.take()
+	if len(buf) > 0 {
+		grw.detectContentType(buf)
+	}
+	grw.writeHeader(compress)
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := grw.write(buf)
+	return err
+}
+
+// Flush sends any buffered data to the client. When compression is enabled the
+// compressing writer is flushed first so the compressed bytes reach the
+// underlying ResponseWriter. A response that is still buffering for the
+// minimum size is committed to compression, as the handler wants its bytes on
+// the wire. Before any of the body was written the decision is made from the
+// Content-Type and Content-Length the handler set, so that the status code is
+// sent, for example to start a stream of Server-Sent Events. Without either
+// header nothing is known about the body yet, so the decision stays pending
+// and nothing is sent.
+func (grw *gzipResponseWriter) Flush() {
+	grw.lock()
+	defer grw.unlock()
+	if !grw.closed && !grw.aborted {
+		grw.flush()
+	}
+}
+
+// flush implements Flush, the caller holds the lock.
+func (grw *gzipResponseWriter) flush() {
+	if grw.status == COMPRESSION_CHECK && grw.peek.len() == 0 &&
+		grw.Header().Get(headerContentType) == "" && grw.Header().Get(headerContentLength) == "" {
+		return
+	}
+	if grw.status == COMPRESSION_CHECK {
+		large, known := grw.checkSize()
+		grw.commit(large || !known)
+	}
+	if grw.status == COMPRESSION_ENABLED {
+		grw.w.Flush()
+		if grw.coalesced != nil {
+			grw.coalesced.Flush()
+		}
+		if grw.compressed != nil {
+			grw.sendCompressed()
+		}
+	}
+	grw.unflushed = 0
+	grw.ResponseWriter.Flush()
+}
+
+// lock locks grw if the handler is ThreadSafe.
+func (grw *gzipResponseWriter) lock() {
+	if grw.h.ThreadSafe {
+		grw.mu.Lock()
+	}
+}
+
+// unlock unlocks grw if the handler is ThreadSafe.
+func (grw *gzipResponseWriter) unlock() {
+	if grw.h.ThreadSafe {
+		grw.mu.Unlock()
+	}
+}
+
+// Hijack lets the handler take over the connection. Compression is disabled
+// and any buffered body is discarded, so nothing passes through the
+// compressing writer. It fails if compressed output has already started.
+func (grw *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	grw.lock()
+	defer grw.unlock()
+	if grw.status == COMPRESSION_ENABLED {
+		return nil, nil, errHijackCompressed
+	}
+	hijacker, ok := grw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("gzip: the ResponseWriter doesn't support the Hijacker interface")
+	}
+	if grw.status == COMPRESSION_CHECK {
+		grw.h.skip(grw, grw.r, "connection hijacked")
+	}
+	grw.status = COMPRESSION_DISABLED
+	grw.peek.take()
+	return hijacker.Hijack()
+}
+
+// Push initiates an HTTP/2 server push if the underlying ResponseWriter
+// supports it, and returns http.ErrNotSupported otherwise.
+func (grw *gzipResponseWriter) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := grw.ResponseWriter.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Abort discards the rest of the response, for handlers that fail halfway
+// through it. Nothing more is written, not even the end of a compressed
+// stream, so the client can tell the body is incomplete. Writes after it fail
+// with ErrAborted, and OnError and OnComplete are not called. To have the
+// connection reset, the handler can panic with http.ErrAbortHandler after
+// calling Abort.
+//
+// If the status code wasn't sent yet, because the compression decision is
+// pending or BufferCompressed holds the body, the response is replaced with a
+// 500 Internal Server Error instead. Otherwise net/http would send an empty
+// 200 OK, telling the client the response succeeded.
+func (grw *gzipResponseWriter) Abort() {
+	grw.lock()
+	defer grw.unlock()
+	if grw.closed || grw.aborted {
+		return
+	}
+	if grw.status == COMPRESSION_CHECK || grw.compressed != nil {
+		grw.peek.take()
+		grw.compressed = nil
+		grw.status = COMPRESSION_DISABLED
+		grw.fail()
+	}
+	grw.aborted = true
+	grw.err = ErrAborted
+}
+
+// Unwrap returns the ResponseWriter the middleware was passed, so an
+// http.ResponseController can reach features of the connection the wrapper
+// doesn't implement itself. The negroni.ResponseWriter the middleware wraps
+// it in can't be unwrapped, so it is skipped. Writing to the result directly
+// bypasses compression.
+func (grw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return grw.original
+}
+
+// SetReadDeadline sets the read deadline of the underlying connection, so
+// handlers can time out slow clients. It returns an error wrapping
+// http.ErrNotSupported if the ResponseWriter the middleware was passed
+// doesn't support it.
+func (grw *gzipResponseWriter) SetReadDeadline(deadline time.Time) error {
+	return http.NewResponseController(grw.original).SetReadDeadline(deadline)
+}
+
+// SetWriteDeadline is SetReadDeadline for the write deadline.
+func (grw *gzipResponseWriter) SetWriteDeadline(deadline time.Time) error {
+	return http.NewResponseController(grw.original).SetWriteDeadline(deadline)
+}
+
+// CloseNotify returns the channel of the underlying ResponseWriter that
+// receives a value when the client goes away, so long-polling handlers keep
+// working. If the underlying ResponseWriter doesn't support it the returned
+// channel never receives.
+//
+// Deprecated: handlers should use the request's Context instead, like with
+// http.CloseNotifier.
+func (grw *gzipResponseWriter) CloseNotify() <-chan bool {
+	if notifier, ok := grw.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return nil
+}
+
+// close finishes the response. A body that never reached the minimum size is
+// written out uncompressed with the headers the handler set, and a handler
+// that wrote nothing at all gets a plain 200 without Content-Encoding. It
+// runs when the handler returns, before net/http sends the trailers, so
+// trailers the handler set end up after the complete compressed body.
+func (grw *gzipResponseWriter) close() {
+	grw.lock()
+	defer grw.unlock()
+	grw.closed = true
+	if grw.aborted {
+		return
+	}
+
+	var err error
+	if grw.status == COMPRESSION_CHECK {
+		// The whole body is known now, so only its size matters.
+		large, known := grw.checkSize()
+		if !known {
+			large = grw.peek.len() >= grw.h.MinSize
+		}
+		err = grw.commit(large && grw.peek.len() > 0)
+	}
+
+	if grw.status == COMPRESSION_ENABLED {
+		// Calling .Close() does write the GZIP header.
+		// This should only happend when compression is enabled.
+		if closeErr := grw.w.Close(); err == nil {
+			err = closeErr
+		}
+		if grw.coalesced != nil {
+			if flushErr := grw.coalesced.Flush(); err == nil {
+				err = flushErr
+			}
+		}
+		// The whole compressed body was buffered, so its length is known.
+		if grw.compressed != nil {
+			grw.Header().Set(headerContentLength, strconv.Itoa(grw.compressed.Len()))
+			if sendErr := grw.sendCompressed(); err == nil {
+				err = sendErr
+			}
+		}
+	}
+	// Only the first error is reported, later ones follow from it.
+	if grw.err != nil {
+		err = grw.err
+	}
+	if err != nil {
+		grw.h.error(err)
+	}
+	if grw.h.OnComplete != nil && grw.reason == "" {
+		grw.h.OnComplete(Stats{
+			Label:             grw.h.Label,
+			Encoding:          grw.encoding,
+			Compressed:        grw.status == COMPRESSION_ENABLED,
+			UncompressedBytes: grw.uncompressed,
+			CompressedBytes:   grw.bytesWritten(),
+		})
 	}
 }
 
 // handler struct contains the ServeHTTP method and the compressionLevel to be
 // used.
+//
+// The gzip streams it writes have a zero ModTime and an unknown OS in their
+// header, so the same body compressed at the same level always yields the
+// same bytes, for example for content-addressed caches. That doesn't apply to
+// writers created by a WriterFactory.
 type handler struct {
 	compressionLevel int
-	allowCompression AllowCompressionFunc
+	allowCompression AllowCompressionFuncWithStatus
+	// allowCompressionE is consulted after allowCompression.
+	allowCompressionE AllowCompressionFuncE
+	encodings         []string
+	pools             encoderPools
+	buffers           sync.Pool
+	coalescers        sync.Pool
+
+	// MinSize is the number of body bytes a response needs to reach before it
+	// is compressed. Smaller responses are sent uncompressed. Zero compresses
+	// every response. If the handler sets a Content-Length it is compared
+	// with MinSize right away, otherwise the body is buffered until it
+	// reaches MinSize.
+	MinSize int
+
+	// PeekFirstWrite only holds back the first write for MinSize. If the
+	// handler returns after it, that write was the whole body and is
+	// compared with MinSize. A second write means the body is streamed,
+	// and it is compressed without waiting for MinSize bytes.
+	PeekFirstWrite bool
+
+	// ExcludedContentTypes lists the media types that are never compressed.
+	// Entries are media types, types with a wildcard subtype such as
+	// "video/*", or "*/*". Parameters like charset and case are ignored when
+	// matching. When nil, DefaultExcludedContentTypes is used. Set it to an
+	// empty slice to compress every type.
+	ExcludedContentTypes []string
+
+	// CompressibleTypes, when not nil, restricts compression to the listed
+	// media types. It is matched the same way as ExcludedContentTypes. For a
+	// response matching both lists the more specific entry wins, so "image/*"
+	// here and "image/png" in ExcludedContentTypes compress all images but
+	// PNGs. A response matching equally specific entries in both lists is
+	// not compressed.
+	CompressibleTypes []string
+
+	// OnError, if set, is called with errors that occur while finishing a
+	// response after the handler returned, such as a failure to write the
+	// end of the compressed stream. Such errors are ignored when it is nil.
+	OnError func(error)
+
+	// OnComplete, if set, is called with the Stats of every response the
+	// handler negotiated an encoding for, once the response is finished.
+	OnComplete func(Stats)
+
+	// Label names the handler in its Stats, to tell the metrics of
+	// differently configured handlers apart.
+	Label string
+
+	// OnSkip, if set, is called with the request and a description of the
+	// reason whenever a response is not compressed, for example because
+	// the client doesn't accept any encoding or the content type is
+	// excluded. It is meant for logging, the reasons are not stable.
+	OnSkip func(r *http.Request, reason string)
+
+	// DebugHeaders sets an X-Gzip-Skipped header with the reason on
+	// responses that are not compressed, the same reason OnSkip is passed.
+	// It exposes the handler's configuration to clients and is meant for
+	// debugging only.
+	DebugHeaders bool
+
+	// OnEnable, if set, is called with the request and the Content-Encoding
+	// when compression is enabled for a response.
+	OnEnable func(r *http.Request, encoding string)
+
+	// CacheableOnly only compresses responses that shared caches may store,
+	// leaving private and dynamic ones uncompressed to save CPU. Responses
+	// whose Cache-Control has a "private" or "no-store" directive are not
+	// cacheable, all others are, including those without Cache-Control.
+	CacheableOnly bool
+
+	// SkipTransferEncoding leaves responses uncompressed if the handler set
+	// a Transfer-Encoding header, for intermediaries that can't handle it
+	// together with Content-Encoding.
+	SkipTransferEncoding bool
+
+	// ExcludedPaths lists URL path prefixes that are never compressed.
+	ExcludedPaths []string
+
+	// SkipMethods lists request methods whose responses are never
+	// compressed, such as "OPTIONS". HEAD requests are always skipped.
+	SkipMethods []string
+
+	// DisableHeader names a request header that disables compression, such
+	// as "X-No-Compress", for inspecting raw responses. Any value disables
+	// compression, unless DisableHeaderValue is set, which the value then
+	// has to match, ignoring case.
+	DisableHeader      string
+	DisableHeaderValue string
+
+	// ExcludedPathRegexps lists patterns matching URL paths that are never
+	// compressed.
+	ExcludedPathRegexps []*regexp.Regexp
+
+	// AutoFlush flushes the response after every write, so streamed
+	// responses aren't held back by the compressing writer. It is always on
+	// for text/event-stream, application/x-ndjson, application/ndjson and
+	// application/stream+json responses.
+	AutoFlush bool
+
+	// FlushThreshold, when positive, flushes a compressed response once
+	// that many uncompressed bytes were written since the last flush. This
+	// bounds how long the compressing writer holds back a stream.
+	FlushThreshold int
+
+	// CompressEventStreams enables compression of text/event-stream
+	// responses. Server-Sent Events are not compressed by default, as the
+	// flush after every event defeats compression and adds latency, and
+	// some proxies mishandle compressed event streams.
+	CompressEventStreams bool
+
+	// WriterFactory, if set, creates the compressing writers instead of the
+	// built-in gzip and Brotli encoders. Its writers are used for every
+	// negotiated encoding, so set the encodings to the one it produces. For
+	// example, a factory returning a zlib.Writer with a preset dictionary
+	// goes with WithEncodings("deflate").
+	WriterFactory WriterFactory
+
+	// StrictNegotiation responds with 406 Not Acceptable when the client
+	// accepts neither one of the handler's encodings nor an uncompressed
+	// response, e.g. "Accept-Encoding: identity;q=0, *;q=0". By default such
+	// requests are served uncompressed.
+	StrictNegotiation bool
+
+	// AcceptEncodingHeader names the request header the encoding is
+	// negotiated from, for proxies that move Accept-Encoding to a header
+	// such as X-Accept-Encoding. When empty, Accept-Encoding is used. The
+	// Vary header still names Accept-Encoding, which is what clients send,
+	// set VaryHeaders to change that.
+	AcceptEncodingHeader string
+
+	// LevelFunc, if set, chooses the compression level for each response. It
+	// is called once compression has been decided on, when the response
+	// headers are known, and overrides the handler's level. Responses with an
+	// invalid level are not compressed.
+	LevelFunc func(w http.ResponseWriter, r *http.Request) int
+
+	// StripAcceptRanges removes the Accept-Ranges header from compressed
+	// responses, so clients don't send range requests for them.
+	StripAcceptRanges bool
+
+	// BuggyClientFunc matches clients that advertise compression but can't
+	// handle it, their responses are not compressed. When nil,
+	// DefaultBuggyClient is used. Set it to a func returning false to
+	// compress for every client.
+	BuggyClientFunc BuggyClientFunc
+
+	// NoVary leaves the Vary header of compressed responses alone, for
+	// setups that manage it elsewhere, such as at a CDN.
+	NoVary bool
+
+	// VaryHeaders, if set, replaces the Vary header of compressed responses
+	// with the listed header names. By default Accept-Encoding is added to
+	// the Vary header the handler set. NoVary takes precedence.
+	VaryHeaders []string
+
+	// AlwaysVary sets the Vary header on uncompressed responses as well,
+	// so shared caches don't serve a compressed response to a client that
+	// can't decompress it. Responses for ExcludedPaths are left alone.
+	AlwaysVary bool
+
+	// ThreadSafe guards WriteHeader, Write and Flush of the ResponseWriter
+	// passed to the next handler with a mutex, for handlers that write to
+	// it from several goroutines. Methods that report its state, such as
+	// Status and WasCompressed, take the mutex as well, so callbacks that
+	// run while writing, such as the AllowCompressionFunc and LevelFunc,
+	// must not call them. Writes from goroutines that outlive the handler
+	// fail with ErrWriteAfterClose. It is off by default, as it costs a
+	// lock on every write.
+	ThreadSafe bool
+
+	// MaxBytes limits the number of compressed bytes sent for a response.
+	// Once the compressing writer produced that many, Write fails with
+	// ErrMaxBytes so the handler can abort. Bytes held back by
+	// BufferCompressed and CoalesceWrites count as produced, but those the
+	// compressing writer holds back itself don't, so the limit may be
+	// overshot by up to about 64KB. Zero means no limit.
+	MaxBytes int64
+
+	// DetectContentType, if set, replaces http.DetectContentType for
+	// responses without a Content-Type. It is passed the start of the body
+	// and its result is matched against the content type lists like a
+	// Content-Type the handler set.
+	DetectContentType func(b []byte) string
+
+	// AlwaysDetectContentType also sets a missing Content-Type from the
+	// start of the body for responses skipped before they were wrapped,
+	// for example because the client doesn't accept compression. Other
+	// responses always get one.
+	AlwaysDetectContentType bool
+
+	// SniffCompressibility samples the start of a body whose type is
+	// unknown, application/octet-stream or undetectable, and leaves it
+	// uncompressed if it looks like random data, as already compressed or
+	// encrypted data does.
+	SniffCompressibility bool
+
+	// BufferCompressed keeps the compressed body of a response in memory
+	// while it is smaller than BufferCompressedSize, so a small response is
+	// sent in one piece with a Content-Length instead of chunked. Larger
+	// responses, and those the handler flushes, are streamed as usual.
+	BufferCompressed bool
+
+	// BufferCompressedSize is the number of compressed bytes buffered with
+	// BufferCompressed. Zero means 32KB.
+	BufferCompressedSize int
+
+	// CoalesceWrites collects the output of the compressing writer into
+	// writes of CoalesceSize bytes, so large responses take fewer writes to
+	// the underlying ResponseWriter. Flush and the end of the response
+	// write out what was collected.
+	CoalesceWrites bool
+
+	// CoalesceSize is the size of the writes with CoalesceWrites. Zero
+	// means 32KB.
+	CoalesceSize int
+
+	// ShouldCompressStatus decides which status codes are compressed. When
+	// nil, DefaultShouldCompressStatus is used, WithOnly2xx sets one that
+	// only compresses successful responses. Responses that can't carry a
+	// body and partial content are never compressed, whatever it returns.
+	ShouldCompressStatus func(code int) bool
+
+	// ResetOnRewrite supports handlers that start a response and then hand
+	// over to another one, such as an error handler that writes a new
+	// status code and body. Normally only the first WriteHeader counts and
+	// later writes are appended to the body. With ResetOnRewrite, a second
+	// WriteHeader, or one after the handler wrote without calling it,
+	// discards the status and the body written so far, as long as none of
+	// it was sent to the client yet because the compression decision is
+	// still pending. Once the response was sent, later WriteHeader calls
+	// are ignored as usual.
+	ResetOnRewrite bool
+
+	// Force compresses responses with the most preferred encoding even if
+	// the client didn't accept it. This violates the HTTP specification and
+	// is only meant for clients that are known to handle compressed
+	// responses, such as internal services. The WebSocket and already
+	// compressed checks still apply.
+	Force bool
+}
+
+// newWriter returns the compressing writer for encoding writing to w. It is
+// created by the WriterFactory if there is one, and otherwise taken from the
+// pool of built-in encoders for the level.
+func (h *handler) newWriter(encoding string, w io.Writer, level int) (WriteFlushCloser, error) {
+	if h.WriterFactory != nil {
+		return h.WriterFactory(w)
+	}
+	return h.pools.get(encoding, w, level)
+}
+
+// releaseWriter returns a writer created by newWriter to its pool. The
+// writer must be closed or not have been written to.
+func (h *handler) releaseWriter(encoding string, level int, w WriteFlushCloser) {
+	if enc, ok := w.(encoder); ok && h.WriterFactory == nil {
+		h.pools.put(encoding, level, enc)
+	}
+}
+
+// getBuffer returns an empty buffer from the pool of buffers that hold the
+// start of a body while the compression decision is pending. Buffers have room
+// for the content type sniffing window and are put back by ServeHTTP.
+func (h *handler) getBuffer() *[]byte {
+	if bufp, ok := h.buffers.Get().(*[]byte); ok {
+		return bufp
+	}
+	buf := make([]byte, 0, sniffLen)
+	return &buf
+}
+
+// getCoalescer returns a bufio.Writer of CoalesceSize writing to w, from the
+// pool if possible.
+func (h *handler) getCoalescer(w io.Writer) *bufio.Writer {
+	if bw, ok := h.coalescers.Get().(*bufio.Writer); ok {
+		bw.Reset(w)
+		return bw
+	}
+	size := h.CoalesceSize
+	if size <= 0 {
+		size = defaultCoalesceSize
+	}
+	return bufio.NewWriterSize(w, size)
+}
+
+// putCoalescer returns bw to the pool. Anything it holds is discarded.
+func (h *handler) putCoalescer(bw *bufio.Writer) {
+	bw.Reset(nil)
+	h.coalescers.Put(bw)
+}
+
+// skipMethod reports whether method is one of the SkipMethods.
+func (h *handler) skipMethod(method string) bool {
+	for _, skip := range h.SkipMethods {
+		if method == skip {
+			return true
+		}
+	}
+	return false
+}
+
+// disabledByHeader reports whether the request carries the DisableHeader.
+func (h *handler) disabledByHeader(r *http.Request) bool {
+	if h.DisableHeader == "" {
+		return false
+	}
+	values := r.Header.Values(h.DisableHeader)
+	if h.DisableHeaderValue == "" {
+		return len(values) > 0
+	}
+	for _, value := range values {
+		if strings.EqualFold(strings.TrimSpace(value), h.DisableHeaderValue) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedPath reports whether compression is disabled for the URL path.
+func (h *handler) excludedPath(path string) bool {
+	for _, prefix := range h.ExcludedPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	for _, re := range h.ExcludedPathRegexps {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats describes how a response passing through the handler was written.
+type Stats struct {
+	// Label is the Label of the handler.
+	Label string
+	// Encoding is the Content-Encoding negotiated with the client.
+	Encoding string
+	// Compressed reports whether the response was actually compressed.
+	Compressed bool
+	// UncompressedBytes is the number of body bytes written by the handler.
+	UncompressedBytes int64
+	// CompressedBytes is the number of body bytes sent to the client. It
+	// equals UncompressedBytes when the response was not compressed.
+	CompressedBytes int64
+}
+
+// error passes err to the OnError callback, if there is one.
+func (h *handler) error(err error) {
+	if h.OnError != nil {
+		h.OnError(err)
+	}
+}
+
+// skip passes the request and the reason it is not compressed to the OnSkip
+// callback, if there is one, and sets the X-Gzip-Skipped header of the
+// response w with DebugHeaders.
+func (h *handler) skip(w http.ResponseWriter, r *http.Request, reason string) {
+	if h.DebugHeaders {
+		w.Header().Set(headerGzipSkipped, reason)
+	}
+	if h.OnSkip != nil {
+		h.OnSkip(r, reason)
+	}
+}
+
+// enable passes the request and its encoding to the OnEnable callback, if
+// there is one.
+func (h *handler) enable(r *http.Request, encoding string) {
+	if h.OnEnable != nil {
+		h.OnEnable(r, encoding)
+	}
+}
+
+// bufferCompressedSize returns the configured BufferCompressedSize or the
+// default.
+func (h *handler) bufferCompressedSize() int {
+	if h.BufferCompressedSize <= 0 {
+		return defaultBufferCompressedSize
+	}
+	return h.BufferCompressedSize
+}
+
+// shouldCompressStatus reports whether responses with the status code are
+// compressed. Responses that can't carry a body never are, for the others the
+// configured ShouldCompressStatus or DefaultShouldCompressStatus decides.
+func (h *handler) shouldCompressStatus(code int) bool {
+	if !bodyAllowed(code) {
+		return false
+	}
+	if h.ShouldCompressStatus == nil {
+		return DefaultShouldCompressStatus(code)
+	}
+	return h.ShouldCompressStatus(code)
+}
+
+// acceptEncodingHeader returns the configured AcceptEncodingHeader or
+// Accept-Encoding.
+func (h *handler) acceptEncodingHeader() string {
+	if h.AcceptEncodingHeader == "" {
+		return headerAcceptEncoding
+	}
+	return h.AcceptEncodingHeader
+}
+
+// vary sets the Vary header of a compressed response according to NoVary and
+// VaryHeaders.
+func (h *handler) vary(headers http.Header) {
+	switch {
+	case h.NoVary:
+	case h.VaryHeaders != nil:
+		headers.Set(headerVary, strings.Join(h.VaryHeaders, ", "))
+	case !varies(headers, headerAcceptEncoding):
+		headers.Add(headerVary, headerAcceptEncoding)
+	}
+}
+
+// varies reports whether the Vary header already lists name, or "*".
+func varies(headers http.Header, name string) bool {
+	return hasToken(headers, headerVary, name) || hasToken(headers, headerVary, "*")
+}
+
+// cacheable reports whether the Cache-Control of a response lets shared
+// caches store it, see CacheableOnly. Directives with a value, such as
+// private="Set-Cookie", restrict only parts of the response and are ignored.
+func cacheable(headers http.Header) bool {
+	return !hasToken(headers, headerCacheControl, "private") && !hasToken(headers, headerCacheControl, "no-store")
+}
+
+// hasToken reports whether the comma separated list in the header key
+// contains token, ignoring case.
+func hasToken(headers http.Header, key, token string) bool {
+	for _, value := range headers.Values(key) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isWebSocket reports whether r opens a WebSocket connection. That is an
+// HTTP/1.1 upgrade, recognized by its key or its Connection and Upgrade
+// headers, or a CONNECT request as used for WebSockets over HTTP/2.
+func isWebSocket(r *http.Request) bool {
+	if len(r.Header.Get(headerSecWebSocketKey)) > 0 || r.Method == http.MethodConnect {
+		return true
+	}
+	return hasToken(r.Header, headerConnection, "upgrade") && hasToken(r.Header, headerUpgrade, "websocket")
+}
+
+// isUpgrade reports whether r asks to switch the connection to another
+// protocol, such as "Upgrade: h2c". The connection is about to be taken over,
+// so the response must be left alone.
+func isUpgrade(r *http.Request) bool {
+	return hasToken(r.Header, headerConnection, "upgrade") && r.Header.Get(headerUpgrade) != ""
+}
+
+// buggyClient reports whether the client that sent r mishandles compressed
+// responses, using the configured BuggyClientFunc or DefaultBuggyClient.
+func (h *handler) buggyClient(r *http.Request) bool {
+	if h.BuggyClientFunc == nil {
+		return DefaultBuggyClient(r)
+	}
+	return h.BuggyClientFunc(r)
+}
+
+// excludedContentTypes returns the configured ExcludedContentTypes or the
+// default list.
+func (h *handler) excludedContentTypes() []string {
+	if h.ExcludedContentTypes == nil {
+		return DefaultExcludedContentTypes
+	}
+	return h.ExcludedContentTypes
 }
 
 func Default() *handler {
@@ -107,60 +1551,228 @@ func Default() *handler {
 // So you can easily enable/disable compression based on the 'Content-Type' or
 // other response headers if necessary. (e.g 'Content-Range', 'Content-Length' ...)
 func New(level int, fn AllowCompressionFunc) *handler {
-	return &handler{
-		compressionLevel: level,
-		allowCompression: fn,
+	return NewWithOptions(WithLevel(level), WithAllowFunc(fn))
+}
+
+// NewFunc returns a handler that compresses with the writers newWriter
+// creates and advertises them with the Content-Encoding encoding, which the
+// client has to accept. Writers that have a Flush() error method are flushed
+// along with the response, others only write their output when closed or
+// when their own buffering decides to.
+func NewFunc(encoding string, newWriter func(w io.Writer) (io.WriteCloser, error)) *handler {
+	return NewWithOptions(
+		WithEncodings(encoding),
+		WithWriterFactory(func(w io.Writer) (WriteFlushCloser, error) {
+			wc, err := newWriter(w)
+			if err != nil {
+				return nil, err
+			}
+			if wfc, ok := wc.(WriteFlushCloser); ok {
+				return wfc, nil
+			}
+			return nopFlusher{wc}, nil
+		}),
+	)
+}
+
+// NewStrict is like New, but returns an error if level is not a valid
+// compression level instead of leaving responses uncompressed at request
+// time.
+func NewStrict(level int, fn AllowCompressionFunc) (*handler, error) {
+	h := New(level, fn)
+	if err := h.validate(); err != nil {
+		return nil, err
 	}
+	return h, nil
+}
+
+// validate checks that a compressing writer can be created at the configured
+// level for each of the handler's encodings.
+func (h *handler) validate() error {
+	for _, encoding := range h.encodings {
+		if _, err := newEncoder(encoding, io.Discard, h.compressionLevel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewWithEncodings returns a handler which negotiates the Content-Encoding
+// from encodings, in order of preference. Supported encodings are "br",
+// "gzip" and "deflate". The level is passed to each encoder as it is, the
+// scales are not mapped onto each other: gzip and deflate take the levels of
+// compress/gzip up to BestCompression (9), Brotli takes 0 to 11. A level
+// outside the scale of an encoding leaves its responses uncompressed, only
+// DefaultCompression picks the default of every encoding.
+//
+// For example, NewWithEncodings([]string{"br", "gzip", "deflate"},
+// DefaultCompression) serves Brotli to clients accepting it, gzip to the rest
+// and deflate to clients accepting neither.
+func NewWithEncodings(encodings []string, level int) *handler {
+	return NewWithOptions(WithEncodings(encodings...), WithLevel(level))
+}
+
+// Wrap returns an http.Handler that compresses the responses of next, for use
+// with net/http and routers other than Negroni. If next implements
+// Compression it is consulted as if it was attached with WithCompression.
+func (h *handler) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := next.(Compression); ok {
+			r = r.WithContext(WithCompression(r.Context(), c))
+		}
+		h.ServeHTTP(w, r, next.ServeHTTP)
+	})
 }
 
-// ServeHTTP wraps the http.ResponseWriter with a gzip.Writer.
+// ServeHTTP wraps the http.ResponseWriter with a gzip.Writer. The gzip.Writer
+// is only created, or taken from the pool, once the response turns out to be
+// compressed, so responses that are not compressed never allocate one.
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	// Skip compression if the client doesn't accept gzip encoding.
-	if !strings.Contains(r.Header.Get(headerAcceptEncoding), encodingGzip) {
+	// Skip compression for excluded paths. This is checked first, so the
+	// request isn't even negotiated.
+	if h.excludedPath(r.URL.Path) {
+		h.pass(w, r, next, "excluded path")
+		return
+	}
+
+	// The response depends on Accept-Encoding whether or not this one is
+	// compressed, so shared caches need the Vary header on both.
+	if h.AlwaysVary {
+		h.vary(w.Header())
+	}
+
+	// Skip compression for HEAD requests. There is no body, and the
+	// Content-Length the handler sets is what the client asked for.
+	if r.Method == http.MethodHead {
+		h.skip(w, r, "HEAD request")
 		next(w, r)
 		return
 	}
 
+	// Skip compression for methods the handler is configured to leave
+	// alone.
+	if h.skipMethod(r.Method) {
+		h.pass(w, r, next, "skipped method")
+		return
+	}
+
+	// Skip compression if the client doesn't accept any of our encodings.
+	encoding := h.negotiate(r)
+	if h.Force && (encoding == "" || encoding == encodingIdentity) && len(h.encodings) > 0 {
+		encoding = h.encodings[0]
+	}
+	if encoding == "" && h.StrictNegotiation {
+		h.skip(w, r, "no acceptable encoding")
+		http.Error(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+		return
+	}
+	if encoding == "" || encoding == encodingIdentity {
+		h.pass(w, r, next, "no accepted encoding")
+		return
+	}
+
+	// Skip compression for clients known to mishandle compressed
+	// responses.
+	if h.buggyClient(r) {
+		h.pass(w, r, next, "buggy client")
+		return
+	}
+
 	// Skip compression if client attempt WebSocket connection
-	if len(r.Header.Get(headerSecWebSocketKey)) > 0 {
+	if isWebSocket(r) {
+		h.skip(w, r, "WebSocket connection")
 		next(w, r)
 		return
 	}
 
+	// Skip compression for other protocol upgrades, such as HTTP/2
+	// cleartext.
+	if isUpgrade(r) {
+		h.skip(w, r, "protocol upgrade")
+		next(w, r)
+		return
+	}
+
+	// Skip compression if it was disabled for the request.
+	if Disabled(r.Context()) {
+		h.pass(w, r, next, "disabled for the request")
+		return
+	}
+
+	// Skip compression if the request asks for a raw response.
+	if h.disabledByHeader(r) {
+		h.pass(w, r, next, "disabled by request header")
+		return
+	}
+
+	// Skip compression for range requests, the handler may serve a part of
+	// the uncompressed body.
+	if len(r.Header.Get(headerRange)) > 0 {
+		h.pass(w, r, next, "range request")
+		return
+	}
+
 	// Skip compression if already compressed
 	if w.Header().Get(headerContentEncoding) == encodingGzip {
-		next(w, r)
+		h.pass(w, r, next, "already encoded")
 		return
 	}
 
-	// Create new gzip Writer. Skip compression if an invalid compression
-	// level was set.
-	gz, err := gzip.NewWriterLevel(w, h.compressionLevel)
-	if err != nil {
+	h.serve(w, r, next, encoding, "")
+}
+
+// pass serves r without compression for the reason. With
+// AlwaysDetectContentType the response still goes through a
+// gzipResponseWriter, which sets a missing Content-Type and reports the skip
+// once the body starts. Otherwise the skip is reported right away and w is
+// passed on as it is.
+func (h *handler) pass(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, reason string) {
+	if !h.AlwaysDetectContentType {
+		h.skip(w, r, reason)
 		next(w, r)
 		return
 	}
+	h.serve(w, r, next, "", reason)
+}
 
-	// Wrap the original http.ResponseWriter with negroni.ResponseWriter
-	// and create the gzipResponseWriter.
-	nrw := negroni.NewResponseWriter(w)
-	grw := gzipResponseWriter{
-		r:                r,
-		w:                gz,
-		ResponseWriter:   nrw,
-		allowCompression: h.allowCompression,
-		status:           COMPRESSION_CHECK,
+// serve passes r to next with a gzipResponseWriter that compresses with
+// encoding, or leaves the response uncompressed for the reason if it is not
+// empty.
+func (h *handler) serve(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, encoding, reason string) {
+	// Wrap the original http.ResponseWriter with negroni.ResponseWriter,
+	// unless an earlier middleware already did. The compressing writer
+	// writes through it so that its Size counts the bytes sent to the
+	// client.
+	nrw, ok := w.(negroni.ResponseWriter)
+	if !ok {
+		nrw = negroni.NewResponseWriter(w)
 	}
 
+	// Give the request its own opt-out flag, so WithDisabled still works
+	// after it was wrapped.
+	disabled := false
+	r = r.WithContext(context.WithValue(r.Context(), disableKey{}, &disabled))
+
+	// Every request gets its own gzipResponseWriter, which stays closed
+	// once the handler returned.
+	grw := newResponseWriter(h, w, nrw, r, encoding)
+	grw.reason = reason
+
 	defer func() {
-		if grw.status == COMPRESSION_ENABLED {
-			// Calling .Close() does write the GZIP header.
-			// This should only happend when compression is enabled.
-			gz.Close()
+		grw.close()
+		// The compressing writer is only created once compression is
+		// enabled. It is closed by now, so it can be reused by another
+		// request. An aborted one was left unfinished and is dropped.
+		if grw.w != nil && !grw.aborted {
+			h.releaseWriter(encoding, grw.level, grw.w)
+		}
+		if grw.coalesced != nil {
+			h.putCoalescer(grw.coalesced)
 		}
+		grw.peek.release(h)
 	}()
 
 	// Call the next handler supplying the gzipResponseWriter instead of
 	// the original.
-	next(&grw, r)
+	next(grw, r)
 }
@@ -1,12 +1,29 @@
 package gzip
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"errors"
 	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/codegangsta/negroni"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
@@ -160,3 +177,4061 @@ func Test_ServeHTTP_AllowCompressionFunc_true(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func Test_ServeHTTP_MinSize_Below(t *testing.T) {
+	gzipHandler := Default()
+	gzipHandler.MinSize = len(gzipTestString) + 1
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerContentLength, strconv.Itoa(len(gzipTestString)))
+		testHTTPContent(w, r)
+	})
+
+	if w.Header().Get(headerContentEncoding) != "" {
+		t.Fail()
+	}
+	if w.Header().Get(headerContentLength) != strconv.Itoa(len(gzipTestString)) {
+		t.Fail()
+	}
+	if w.Body.String() != gzipTestString {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_MinSize_Above(t *testing.T) {
+	gzipHandler := Default()
+	gzipHandler.MinSize = len(gzipTestString)
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerContentLength, strconv.Itoa(len(gzipTestString)))
+		fmt.Fprint(w, gzipTestString[:3])
+		fmt.Fprint(w, gzipTestString[3:])
+	})
+
+	if w.Header().Get(headerContentEncoding) != encodingGzip {
+		t.Fail()
+	}
+	if w.Header().Get(headerContentLength) != "" {
+		t.Fail()
+	}
+
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gr.Close()
+
+	body, _ := ioutil.ReadAll(gr)
+
+	if string(body) != gzipTestString {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_Flush(t *testing.T) {
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+		testHTTPContent(rw, r)
+		rw.(http.Flusher).Flush()
+
+		if !w.Flushed {
+			t.Fatal("response was not flushed")
+		}
+
+		// The flushed bytes must already decompress to the full body even
+		// though the gzip stream is not closed yet.
+		gr, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := make([]byte, len(gzipTestString))
+		if _, err := io.ReadFull(gr, body); err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != gzipTestString {
+			t.Fail()
+		}
+	})
+}
+
+// hijackRecorder is a ResponseRecorder that also implements http.Hijacker.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (hr *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hr.hijacked = true
+	return nil, nil, nil
+}
+
+func Test_ServeHTTP_Hijack(t *testing.T) {
+	gzipHandler := Default()
+	w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+		if _, _, err := rw.(http.Hijacker).Hijack(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if !w.hijacked {
+		t.Fail()
+	}
+	if w.Header().Get(headerContentEncoding) != "" || w.Body.Len() != 0 {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_HijackAfterCompression(t *testing.T) {
+	gzipHandler := Default()
+	w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set(headerContentType, "text/plain")
+		testHTTPContent(rw, r)
+		if _, _, err := rw.(http.Hijacker).Hijack(); err != errHijackCompressed {
+			t.Fail()
+		}
+	})
+
+	if w.hijacked {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_Brotli(t *testing.T) {
+	gzipHandler := NewWithEncodings([]string{encodingBrotli, encodingGzip}, DefaultCompression)
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, "gzip, deflate, br")
+
+	gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+	if w.Header().Get(headerContentEncoding) != encodingBrotli {
+		t.Fail()
+	}
+
+	body, _ := ioutil.ReadAll(brotli.NewReader(w.Body))
+
+	if string(body) != gzipTestString {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_BrotliFallbackToGzip(t *testing.T) {
+	gzipHandler := NewWithEncodings([]string{encodingBrotli, encodingGzip}, DefaultCompression)
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+	if w.Header().Get(headerContentEncoding) != encodingGzip {
+		t.Fail()
+	}
+
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gr.Close()
+
+	body, _ := ioutil.ReadAll(gr)
+
+	if string(body) != gzipTestString {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_GzipQValueZero(t *testing.T) {
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, "gzip;q=0")
+
+	gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+	if w.Header().Get(headerContentEncoding) != "" {
+		t.Fail()
+	}
+	if w.Body.String() != gzipTestString {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_PooledWriterReuse(t *testing.T) {
+	// Compression is disabled for /plain so that writers which were never
+	// written to are returned to the pool as well.
+	gzipHandler := New(gzip.DefaultCompression,
+		func(w http.ResponseWriter, r *http.Request) bool {
+			return r.URL.Path != "/plain"
+		},
+	)
+
+	for _, path := range []string{"/foobar", "/plain", "/foobar", "/foobar"} {
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+		if path == "/plain" {
+			if w.Body.String() != gzipTestString {
+				t.Fail()
+			}
+			continue
+		}
+
+		gr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(gr)
+		gr.Close()
+
+		if string(body) != gzipTestString {
+			t.Fail()
+		}
+	}
+}
+
+func Test_ServeHTTP_ExcludedContentType_Default(t *testing.T) {
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	png := "\x89PNG\x0D\x0A\x1A\x0A" + gzipTestString
+	gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, png)
+	})
+
+	if w.Header().Get(headerContentType) != "image/png" {
+		t.Fail()
+	}
+	if w.Header().Get(headerContentEncoding) != "" {
+		t.Fail()
+	}
+	if w.Body.String() != png {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_ExcludedContentType_DefaultWildcard(t *testing.T) {
+	for _, contentType := range []string{"video/mp4", "audio/mpeg"} {
+		gzipHandler := Default()
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerContentType, contentType)
+			testHTTPContent(w, r)
+		})
+
+		if w.Header().Get(headerContentEncoding) != "" {
+			t.Errorf("%s: Content-Encoding = %q, want none", contentType, w.Header().Get(headerContentEncoding))
+		}
+		if w.Body.String() != gzipTestString {
+			t.Errorf("%s: body = %q, want %q", contentType, w.Body.String(), gzipTestString)
+		}
+	}
+}
+
+func Test_ServeHTTP_ExcludedContentType_Custom(t *testing.T) {
+	gzipHandler := Default()
+	gzipHandler.ExcludedContentTypes = []string{"application/pdf"}
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerContentType, "Application/PDF; charset=binary")
+		testHTTPContent(w, r)
+	})
+
+	if w.Header().Get(headerContentEncoding) != "" {
+		t.Fail()
+	}
+	if w.Body.String() != gzipTestString {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_ExcludedContentType_Empty(t *testing.T) {
+	gzipHandler := Default()
+	gzipHandler.ExcludedContentTypes = []string{}
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerContentType, "image/png")
+		testHTTPContent(w, r)
+	})
+
+	if w.Header().Get(headerContentEncoding) != encodingGzip {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_CompressibleTypes(t *testing.T) {
+	gzipHandler := Default()
+	gzipHandler.CompressibleTypes = []string{"text/html", "application/json"}
+
+	for contentType, compressed := range map[string]bool{
+		"application/json":          true,
+		"TEXT/HTML; charset=utf-8":  true,
+		"text/plain; charset=utf-8": false,
+	} {
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerContentType, contentType)
+			testHTTPContent(w, r)
+		})
+
+		if (w.Header().Get(headerContentEncoding) == encodingGzip) != compressed {
+			t.Errorf("%s: compressed = %v, want %v", contentType, !compressed, compressed)
+		}
+	}
+}
+
+func Test_ServeHTTP_WeakenETag(t *testing.T) {
+	gzipHandler := Default()
+
+	for etag, want := range map[string]string{
+		`"abc"`:   `W/"abc"`,
+		`W/"abc"`: `W/"abc"`,
+		"":        "",
+	} {
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			if etag != "" {
+				w.Header().Set(headerETag, etag)
+			}
+			testHTTPContent(w, r)
+		})
+
+		if got := w.Header().Get(headerETag); got != want {
+			t.Errorf("ETag %q became %q, want %q", etag, got, want)
+		}
+	}
+}
+
+func Test_ServeHTTP_StrongETagWithoutCompression(t *testing.T) {
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerETag, `"abc"`)
+		testHTTPContent(w, r)
+	})
+
+	if w.Header().Get(headerETag) != `"abc"` {
+		t.Fail()
+	}
+}
+
+// failingRecorder is a ResponseRecorder whose body writes always fail.
+type failingRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (fr failingRecorder) Write(b []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func Test_ServeHTTP_OnError(t *testing.T) {
+	var errs []error
+	gzipHandler := Default()
+	gzipHandler.OnError = func(err error) {
+		errs = append(errs, err)
+	}
+	w := failingRecorder{httptest.NewRecorder()}
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+	if len(errs) != 1 {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_OnComplete(t *testing.T) {
+	var stats []Stats
+	gzipHandler := Default()
+	gzipHandler.OnComplete = func(s Stats) {
+		stats = append(stats, s)
+	}
+	content := strings.Repeat(gzipTestString, 100)
+
+	for _, acceptEncoding := range []string{encodingGzip, "identity"} {
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, acceptEncoding)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, content)
+		})
+	}
+
+	// Requests without an acceptable encoding are not wrapped and do not
+	// report stats.
+	if len(stats) != 1 {
+		t.Fatalf("got %d stats, want 1", len(stats))
+	}
+	s := stats[0]
+	if s.Encoding != encodingGzip || !s.Compressed {
+		t.Fail()
+	}
+	if s.UncompressedBytes != int64(len(content)) {
+		t.Errorf("UncompressedBytes = %d, want %d", s.UncompressedBytes, len(content))
+	}
+	if s.CompressedBytes == 0 || s.CompressedBytes >= s.UncompressedBytes {
+		t.Errorf("CompressedBytes = %d", s.CompressedBytes)
+	}
+}
+
+func Test_ServeHTTP_NoBodyStatus(t *testing.T) {
+	gzipHandler := Default()
+
+	for _, code := range []int{http.StatusNoContent, http.StatusNotModified} {
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		})
+
+		if w.Code != code {
+			t.Errorf("status = %d, want %d", w.Code, code)
+		}
+		if w.Header().Get(headerContentEncoding) != "" {
+			t.Errorf("%d: unexpected Content-Encoding", code)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("%d: unexpected body", code)
+		}
+	}
+}
+
+func Test_ServeHTTP_RangeRequest(t *testing.T) {
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+	req.Header.Set(headerRange, "bytes=0-5")
+
+	gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+	if w.Header().Get(headerContentEncoding) != "" {
+		t.Fail()
+	}
+	if w.Body.String() != gzipTestString {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_ContentRange(t *testing.T) {
+	gzipHandler := Default()
+
+	for _, code := range []int{http.StatusOK, http.StatusPartialContent} {
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerContentRange, fmt.Sprintf("bytes 0-%d/100", len(gzipTestString)-1))
+			w.WriteHeader(code)
+			testHTTPContent(w, r)
+		})
+
+		if w.Header().Get(headerContentEncoding) != "" {
+			t.Errorf("%d: unexpected Content-Encoding", code)
+		}
+		if w.Body.String() != gzipTestString {
+			t.Errorf("%d: body was modified", code)
+		}
+	}
+}
+
+func Test_ServeHTTP_WriteStringAllocs(t *testing.T) {
+	gzipHandler := New(gzip.DefaultCompression, func(w http.ResponseWriter, r *http.Request) bool {
+		return false
+	})
+	w := stringResponseWriter{&discardResponseWriter{header: http.Header{}}}
+	content := strings.Repeat(gzipTestString, 100)
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set(headerContentType, "text/plain")
+		io.WriteString(rw, content)
+
+		// Once compression is disabled the string is not copied.
+		allocs := testing.AllocsPerRun(100, func() {
+			io.WriteString(rw, content)
+		})
+		if allocs != 0 {
+			t.Errorf("allocs = %v, want 0", allocs)
+		}
+		if n := rw.(interface{ BytesWritten() int64 }).BytesWritten(); n != int64(len(content)*102) {
+			t.Errorf("BytesWritten() = %d, want %d", n, len(content)*102)
+		}
+	})
+}
+
+func Test_ServeHTTP_ReadFrom(t *testing.T) {
+	content := "<html>" + strings.Repeat(gzipTestString, 100) + "</html>"
+
+	for _, compressed := range []bool{true, false} {
+		gzipHandler := New(gzip.DefaultCompression,
+			func(w http.ResponseWriter, r *http.Request) bool {
+				return compressed
+			},
+		)
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := w.(io.ReaderFrom); !ok {
+				t.Fatal("ResponseWriter does not implement io.ReaderFrom")
+			}
+			n, err := io.Copy(w, strings.NewReader(content))
+			if err != nil || n != int64(len(content)) {
+				t.Errorf("io.Copy = %d, %v", n, err)
+			}
+		})
+
+		if w.Header().Get(headerContentType) != "text/html; charset=utf-8" {
+			t.Errorf("Content-Type = %q", w.Header().Get(headerContentType))
+		}
+
+		body := w.Body.Bytes()
+		if compressed {
+			gr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ = ioutil.ReadAll(gr)
+			gr.Close()
+		}
+		if string(body) != content {
+			t.Errorf("compressed = %v: body mismatch", compressed)
+		}
+	}
+}
+
+func Test_ServeHTTP_DisabledContext(t *testing.T) {
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+	req = req.WithContext(WithDisabled(req.Context()))
+
+	gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(*gzipResponseWriter); ok {
+			t.Error("ResponseWriter was wrapped")
+		}
+		testHTTPContent(w, r)
+	})
+
+	if w.Header().Get(headerContentEncoding) != "" {
+		t.Fail()
+	}
+	if w.Body.String() != gzipTestString {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_DisabledContextInHandler(t *testing.T) {
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(WithDisabled(r.Context()))
+		if !Disabled(r.Context()) {
+			t.Error("context is not disabled")
+		}
+		testHTTPContent(w, r)
+	})
+
+	if w.Header().Get(headerContentEncoding) != "" {
+		t.Fail()
+	}
+	if w.Body.String() != gzipTestString {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_ExcludedPaths(t *testing.T) {
+	gzipHandler := NewWithOptions(
+		WithExcludedPaths("/metrics"),
+		WithExcludedPathRegexps(regexp.MustCompile(`\.gz$`)),
+	)
+
+	for path, compressed := range map[string]bool{
+		"/metrics":          false,
+		"/metrics/process":  false,
+		"/static/app.js.gz": false,
+		"/foobar":           true,
+		"/static/app.js":    true,
+	} {
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+		if (w.Header().Get(headerContentEncoding) == encodingGzip) != compressed {
+			t.Errorf("%s: compressed = %v, want %v", path, !compressed, compressed)
+		}
+	}
+}
+
+func Test_ServeHTTP_AllowCompressionFunc_false_KeepsContentLength(t *testing.T) {
+	gzipHandler := New(gzip.DefaultCompression,
+		func(w http.ResponseWriter, r *http.Request) bool {
+			return false
+		},
+	)
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerContentLength, strconv.Itoa(len(gzipTestString)))
+		testHTTPContent(w, r)
+	})
+
+	if w.Header().Get(headerContentLength) != strconv.Itoa(len(gzipTestString)) {
+		t.Fail()
+	}
+	if w.Body.String() != gzipTestString {
+		t.Fail()
+	}
+}
+
+// pushRecorder is a ResponseRecorder that also implements http.Pusher.
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (pr *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	pr.pushed = append(pr.pushed, target)
+	return nil
+}
+
+func Test_ServeHTTP_Push(t *testing.T) {
+	gzipHandler := Default()
+	w := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+		pusher, ok := w.(http.Pusher)
+		if !ok {
+			t.Fatal("ResponseWriter does not implement http.Pusher")
+		}
+		if err := pusher.Push("/app.css", nil); err != nil {
+			t.Error(err)
+		}
+		testHTTPContent(w, r)
+	})
+
+	if len(w.pushed) != 1 || w.pushed[0] != "/app.css" {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_PushNotSupported(t *testing.T) {
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+		if err := w.(http.Pusher).Push("/app.css", nil); err == nil {
+			t.Error("Push succeeded without a Pusher")
+		}
+	})
+}
+
+func Test_ServeHTTP_AutoFlush(t *testing.T) {
+	gzipHandler := NewWithOptions(WithAutoFlush(true))
+	events := []string{"data: one\n\n", "data: two\n\n", "data: three\n\n"}
+	read := make(chan struct{})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gzipHandler.ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerContentType, "text/plain")
+			for _, event := range events {
+				fmt.Fprint(w, event)
+				// Wait for the client to see the event before sending the
+				// next one. This deadlocks unless the write was flushed.
+				select {
+				case <-read:
+				case <-time.After(5 * time.Second):
+					t.Error("timed out waiting for the client")
+					return
+				}
+			}
+		})
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get(headerContentEncoding) != encodingGzip {
+		t.Fatal("response is not compressed")
+	}
+
+	gr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		buf := make([]byte, len(event))
+		if _, err := io.ReadFull(gr, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != event {
+			t.Errorf("read %q, want %q", buf, event)
+		}
+		read <- struct{}{}
+	}
+}
+
+func Test_ServeHTTP_AutoFlushEventStream(t *testing.T) {
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set(headerContentType, "text/event-stream")
+		fmt.Fprint(rw, "data: one\n\n")
+		if !w.Flushed {
+			t.Error("event was not flushed")
+		}
+	})
+}
+
+func Test_ServeHTTP_EventStream(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		gzipHandler := NewWithOptions(WithCompressEventStreams(compress))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerContentType, "text/event-stream; charset=utf-8")
+			fmt.Fprint(w, "data: one\n\n")
+		})
+
+		if (w.Header().Get(headerContentEncoding) == encodingGzip) != compress {
+			t.Errorf("CompressEventStreams = %v: wrong Content-Encoding %q", compress, w.Header().Get(headerContentEncoding))
+		}
+		if !compress && w.Body.String() != "data: one\n\n" {
+			t.Fail()
+		}
+	}
+}
+
+// jsonOnly is a Compression that only allows JSON responses.
+type jsonOnly struct{}
+
+func (jsonOnly) AllowCompression(w http.ResponseWriter, r *http.Request) bool {
+	return w.Header().Get(headerContentType) == "application/json"
+}
+
+func Test_ServeHTTP_CompressionInContext(t *testing.T) {
+	for _, test := range []struct {
+		contentType string
+		allowFunc   bool
+		compressed  bool
+	}{
+		{"application/json", true, true},
+		{"text/plain", true, false},
+		{"application/json", false, false},
+	} {
+		allowFunc := test.allowFunc
+		gzipHandler := New(gzip.DefaultCompression,
+			func(w http.ResponseWriter, r *http.Request) bool {
+				return allowFunc
+			},
+		)
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+		req = req.WithContext(WithCompression(req.Context(), jsonOnly{}))
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerContentType, test.contentType)
+			testHTTPContent(w, r)
+		})
+
+		if (w.Header().Get(headerContentEncoding) == encodingGzip) != test.compressed {
+			t.Errorf("%+v: wrong Content-Encoding %q", test, w.Header().Get(headerContentEncoding))
+		}
+	}
+}
+
+func Test_ServeHTTP_WriteCount(t *testing.T) {
+	for _, minSize := range []int{0, 64} {
+		gzipHandler := NewWithOptions(WithMinSize(minSize))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		content := strings.Repeat(gzipTestString, 10)
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			total := 0
+			for i := 0; i < len(content); i += 7 {
+				chunk := content[i:]
+				if len(chunk) > 7 {
+					chunk = chunk[:7]
+				}
+				n, err := w.Write([]byte(chunk))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != len(chunk) {
+					t.Errorf("Write returned %d, want %d", n, len(chunk))
+				}
+				total += n
+			}
+			if total != len(content) {
+				t.Errorf("wrote %d bytes, want %d", total, len(content))
+			}
+		})
+
+		gr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(gr)
+		gr.Close()
+
+		if string(body) != content {
+			t.Fail()
+		}
+	}
+}
+
+func Test_ServeHTTP_WriterFactory(t *testing.T) {
+	dict := []byte(gzipTestString)
+	gzipHandler := NewWithOptions(
+		WithEncodings("deflate"),
+		WithWriterFactory(func(w io.Writer) (WriteFlushCloser, error) {
+			return zlib.NewWriterLevelDict(w, zlib.BestCompression, dict)
+		}),
+	)
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, "gzip, deflate")
+
+	gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+	if w.Header().Get(headerContentEncoding) != "deflate" {
+		t.Fail()
+	}
+
+	zr, err := zlib.NewReaderDict(w.Body, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(zr)
+
+	if string(body) != gzipTestString {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_DoubleWriteHeader(t *testing.T) {
+	for _, minSize := range []int{0, 1024} {
+		gzipHandler := NewWithOptions(WithMinSize(minSize))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.WriteHeader(http.StatusInternalServerError)
+			if status := w.(negroni.ResponseWriter).Status(); status != http.StatusCreated {
+				t.Errorf("Status() = %d, want %d", status, http.StatusCreated)
+			}
+			testHTTPContent(w, r)
+		})
+
+		if w.Code != http.StatusCreated {
+			t.Errorf("MinSize %d: status = %d, want %d", minSize, w.Code, http.StatusCreated)
+		}
+	}
+}
+
+func Test_ServeHTTP_StrictNegotiation(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		gzipHandler := NewWithOptions(WithStrictNegotiation(strict))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, "identity;q=0, *;q=0")
+
+		gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+		if strict {
+			if w.Code != http.StatusNotAcceptable {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusNotAcceptable)
+			}
+		} else if w.Code != http.StatusOK || w.Body.String() != gzipTestString {
+			t.Error("lenient negotiation did not serve the identity response")
+		}
+	}
+}
+
+func Test_ServeHTTP_WriteString(t *testing.T) {
+	for _, compressed := range []bool{true, false} {
+		gzipHandler := New(gzip.DefaultCompression,
+			func(w http.ResponseWriter, r *http.Request) bool {
+				return compressed
+			},
+		)
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			sw, ok := w.(io.StringWriter)
+			if !ok {
+				t.Fatal("ResponseWriter does not implement io.StringWriter")
+			}
+			for _, s := range []string{gzipTestString[:6], gzipTestString[6:]} {
+				if n, err := sw.WriteString(s); err != nil || n != len(s) {
+					t.Errorf("WriteString = %d, %v", n, err)
+				}
+			}
+		})
+
+		body := w.Body.Bytes()
+		if compressed {
+			gr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ = ioutil.ReadAll(gr)
+			gr.Close()
+		}
+		if string(body) != gzipTestString {
+			t.Errorf("compressed = %v: body mismatch", compressed)
+		}
+	}
+}
+
+func Test_ServeHTTP_MinSize_PooledBuffer(t *testing.T) {
+	gzipHandler := NewWithOptions(WithMinSize(sniffLen))
+
+	// Bodies below the buffer size are served from a pooled buffer, which
+	// must not leak data between requests.
+	for _, content := range []string{strings.Repeat("A", 100), "B", strings.Repeat("C", 50)} {
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, content)
+		})
+
+		if w.Header().Get(headerContentEncoding) != "" {
+			t.Fail()
+		}
+		if w.Body.String() != content {
+			t.Errorf("body = %q, want %q", w.Body.String(), content)
+		}
+	}
+}
+
+func Test_ServeHTTP_OtherContentEncoding(t *testing.T) {
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, "gzip, br")
+
+	gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerContentEncoding, encodingBrotli)
+		testHTTPContent(w, r)
+	})
+
+	if w.Header().Get(headerContentEncoding) != encodingBrotli {
+		t.Fail()
+	}
+	if w.Body.String() != gzipTestString {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_Head(t *testing.T) {
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("HEAD", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerContentType, "text/plain")
+		w.Header().Set(headerContentLength, strconv.Itoa(len(gzipTestString)))
+		w.WriteHeader(http.StatusOK)
+	})
+
+	if w.Header().Get(headerContentLength) != strconv.Itoa(len(gzipTestString)) {
+		t.Fail()
+	}
+	if w.Header().Get(headerContentEncoding) != "" {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_LevelFunc(t *testing.T) {
+	gzipHandler := NewWithOptions(WithLevelFunc(func(w http.ResponseWriter, r *http.Request) int {
+		if w.Header().Get(headerContentType) == "text/plain" {
+			return NoCompression
+		}
+		return BestCompression
+	}))
+	content := strings.Repeat(gzipTestString, 100)
+
+	for contentType, stored := range map[string]bool{"text/plain": true, "text/html": false} {
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerContentType, contentType)
+			fmt.Fprint(w, content)
+		})
+
+		// NoCompression stores the body, so the gzip stream is larger
+		// than the body itself.
+		if (w.Body.Len() > len(content)) != stored {
+			t.Errorf("%s: %d compressed bytes for %d bytes of content", contentType, w.Body.Len(), len(content))
+		}
+
+		gr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(gr)
+		gr.Close()
+
+		if string(body) != content {
+			t.Errorf("%s: body mismatch", contentType)
+		}
+	}
+}
+
+func Test_ServeHTTP_LazyWriter(t *testing.T) {
+	created := 0
+	gzipHandler := NewWithOptions(
+		WithAllowFunc(func(w http.ResponseWriter, r *http.Request) bool {
+			return r.URL.Path != "/plain"
+		}),
+		WithWriterFactory(func(w io.Writer) (WriteFlushCloser, error) {
+			created++
+			return gzip.NewWriter(w), nil
+		}),
+	)
+
+	for path, want := range map[string]int{"/plain": 0, "/foobar": 1} {
+		created = 0
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+		if created != want {
+			t.Errorf("%s: created %d writers, want %d", path, created, want)
+		}
+	}
+}
+
+func Test_ServeHTTP_StripAcceptRanges(t *testing.T) {
+	for _, strip := range []bool{false, true} {
+		gzipHandler := NewWithOptions(WithStripAcceptRanges(strip))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerAcceptRanges, "bytes")
+			testHTTPContent(w, r)
+		})
+
+		if w.Header().Get(headerContentEncoding) != encodingGzip {
+			t.Fatal("response is not compressed")
+		}
+		if (w.Header().Get(headerAcceptRanges) == "") != strip {
+			t.Errorf("StripAcceptRanges = %v: Accept-Ranges = %q", strip, w.Header().Get(headerAcceptRanges))
+		}
+	}
+}
+
+func Test_ServeHTTP_Deflate(t *testing.T) {
+	gzipHandler := NewWithEncodings([]string{encodingGzip, encodingDeflate}, DefaultCompression)
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingDeflate)
+
+	gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+	if w.Header().Get(headerContentEncoding) != encodingDeflate {
+		t.Fail()
+	}
+
+	zr, err := zlib.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(zr)
+
+	if string(body) != gzipTestString {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_MinSize_ContentLength(t *testing.T) {
+	gzipHandler := NewWithOptions(WithMinSize(100))
+
+	for _, test := range []struct {
+		contentLength int
+		compressed    bool
+	}{
+		{50, false},
+		{150, true},
+	} {
+		content := strings.Repeat("A", test.contentLength)
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set(headerContentType, "text/plain")
+			rw.Header().Set(headerContentLength, strconv.Itoa(len(content)))
+			rw.WriteHeader(http.StatusOK)
+			fmt.Fprint(rw, content)
+			// The decision is made from the Content-Length at the first
+			// write, without buffering any of the body.
+			if rw.(*gzipResponseWriter).status == COMPRESSION_CHECK {
+				t.Error("compression decision was held back")
+			}
+		})
+
+		if (w.Header().Get(headerContentEncoding) == encodingGzip) != test.compressed {
+			t.Errorf("Content-Length %d: wrong Content-Encoding %q", test.contentLength, w.Header().Get(headerContentEncoding))
+		}
+		if !test.compressed && w.Header().Get(headerContentLength) != strconv.Itoa(len(content)) {
+			t.Errorf("Content-Length %d was not kept", test.contentLength)
+		}
+	}
+}
+
+func Test_ServeHTTP_ContentTypeWildcards(t *testing.T) {
+	gzipHandler := NewWithOptions(
+		WithCompressibleTypes([]string{"image/*", "text/plain"}),
+		WithExcludedTypes([]string{"image/png", "text/*"}),
+	)
+
+	for contentType, compressed := range map[string]bool{
+		"image/svg+xml": true,
+		"image/png":     false,
+		"text/plain":    true,
+		"text/html":     false,
+	} {
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerContentType, contentType)
+			testHTTPContent(w, r)
+		})
+
+		if (w.Header().Get(headerContentEncoding) == encodingGzip) != compressed {
+			t.Errorf("%s: compressed = %v, want %v", contentType, !compressed, compressed)
+		}
+	}
+}
+
+func Test_ServeHTTP_Trailer(t *testing.T) {
+	gzipHandler := Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gzipHandler.ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Checksum")
+			testHTTPContent(w, r)
+			w.Header().Set("X-Checksum", "abc")
+		})
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get(headerContentEncoding) != encodingGzip {
+		t.Fatal("response is not compressed")
+	}
+
+	gr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Trailers are only available once the body has been read to the end.
+	ioutil.ReadAll(resp.Body)
+
+	if string(body) != gzipTestString {
+		t.Fail()
+	}
+	if resp.Trailer.Get("X-Checksum") != "abc" {
+		t.Errorf("trailer = %q, want %q", resp.Trailer.Get("X-Checksum"), "abc")
+	}
+}
+
+func Test_ServeHTTP_Force(t *testing.T) {
+	gzipHandler := NewWithOptions(WithForce(true))
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+	if w.Header().Get(headerContentEncoding) != encodingGzip {
+		t.Fatal("response is not compressed")
+	}
+
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gr.Close()
+
+	body, _ := ioutil.ReadAll(gr)
+
+	if string(body) != gzipTestString {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_Force_WebSocketConnection(t *testing.T) {
+	gzipHandler := NewWithOptions(WithForce(true))
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerSecWebSocketKey, gzipTestWebSocketKey)
+
+	gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+	if w.Body.String() != gzipTestString {
+		t.Fail()
+	}
+}
+
+func Test_ServeHTTP_EmptyHandler(t *testing.T) {
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("X-Foo", "bar")
+	})
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w.Header().Get(headerContentEncoding) != "" {
+		t.Error("empty response has a Content-Encoding")
+	}
+	if w.Header().Get("X-Foo") != "bar" {
+		t.Error("handler header was lost")
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("body = %q, want empty", w.Body.Bytes())
+	}
+}
+
+func Test_ServeHTTP_OnSkip(t *testing.T) {
+	tests := map[string]struct {
+		acceptEncoding string
+		contentType    string
+		reason         string
+	}{
+		"no accept encoding": {"", "text/plain", "no accepted encoding"},
+		"excluded type":      {encodingGzip, "image/png", "content type excluded"},
+		"event stream":       {encodingGzip, "text/event-stream", "event stream"},
+	}
+
+	for name, test := range tests {
+		var reasons []string
+		gzipHandler := NewWithOptions(
+			WithOnSkip(func(r *http.Request, reason string) {
+				reasons = append(reasons, reason)
+			}),
+			WithOnEnable(func(r *http.Request, encoding string) {
+				t.Errorf("%s: compression enabled with %s", name, encoding)
+			}),
+		)
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.acceptEncoding != "" {
+			req.Header.Set(headerAcceptEncoding, test.acceptEncoding)
+		}
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set(headerContentType, test.contentType)
+			rw.Write([]byte(gzipTestString))
+		})
+
+		if len(reasons) != 1 || reasons[0] != test.reason {
+			t.Errorf("%s: reasons = %q, want [%q]", name, reasons, test.reason)
+		}
+	}
+}
+
+func Test_ServeHTTP_OnEnable(t *testing.T) {
+	var encodings []string
+	gzipHandler := NewWithOptions(
+		WithOnSkip(func(r *http.Request, reason string) {
+			t.Errorf("compression skipped: %s", reason)
+		}),
+		WithOnEnable(func(r *http.Request, encoding string) {
+			encodings = append(encodings, encoding)
+		}),
+	)
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+	if len(encodings) != 1 || encodings[0] != encodingGzip {
+		t.Errorf("encodings = %q, want [%q]", encodings, encodingGzip)
+	}
+}
+
+func Test_WasCompressed(t *testing.T) {
+	gzipHandler := NewWithOptions(WithMinSize(len(gzipTestString)))
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+		if WasCompressed(rw) {
+			t.Error("compressed before the first write")
+		}
+		rw.Header().Set(headerContentType, "text/plain")
+		rw.Write([]byte(gzipTestString))
+		if !WasCompressed(rw) {
+			t.Error("not compressed after the first write")
+		}
+	})
+
+	if !WasCompressed(w) {
+		t.Error("recorder with Content-Encoding reported uncompressed")
+	}
+	if WasCompressed(httptest.NewRecorder()) {
+		t.Error("recorder without Content-Encoding reported compressed")
+	}
+}
+
+// discardResponseWriter is a ResponseWriter that throws the body away, so
+// benchmarks only measure the middleware.
+type discardResponseWriter struct {
+	header http.Header
+	writes int
+}
+
+func (w *discardResponseWriter) Header() http.Header { return w.header }
+func (w *discardResponseWriter) WriteHeader(int)     {}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	w.writes++
+	return len(b), nil
+}
+
+// stringResponseWriter is a discardResponseWriter that also implements
+// io.StringWriter.
+type stringResponseWriter struct {
+	*discardResponseWriter
+}
+
+func (w stringResponseWriter) WriteString(s string) (int, error) {
+	w.writes++
+	return len(s), nil
+}
+
+var benchmarkSizes = []int{256, 4 << 10, 64 << 10}
+
+func benchmarkServeHTTP(b *testing.B, h *handler, acceptEncoding string, size int) {
+	body := bytes.Repeat([]byte("negroni-gzip "), size/13+1)[:size]
+	next := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerContentType, "text/plain")
+		w.Write(body)
+	}
+	w := &discardResponseWriter{header: http.Header{}}
+	req := httptest.NewRequest("GET", "http://localhost/foobar", nil)
+	if acceptEncoding != "" {
+		req.Header.Set(headerAcceptEncoding, acceptEncoding)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// A Content-Encoding left over from the last response would
+		// skip compression.
+		clear(w.header)
+		h.ServeHTTP(w, req, next)
+	}
+}
+
+func Benchmark_ServeHTTP_Compressed(b *testing.B) {
+	for _, level := range []int{BestSpeed, DefaultCompression, BestCompression} {
+		for _, size := range benchmarkSizes {
+			b.Run(fmt.Sprintf("level=%d/size=%d", level, size), func(b *testing.B) {
+				benchmarkServeHTTP(b, New(level, nil), encodingGzip, size)
+			})
+		}
+	}
+}
+
+func Benchmark_ServeHTTP_CoalesceWrites(b *testing.B) {
+	body := bytes.Repeat([]byte("negroni-gzip "), 1<<16)
+	next := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerContentType, "text/plain")
+		for i := 0; i < len(body); i += 4 << 10 {
+			w.Write(body[i:min(i+4<<10, len(body))])
+		}
+	}
+	req := httptest.NewRequest("GET", "http://localhost/foobar", nil)
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	for _, coalesce := range []bool{false, true} {
+		b.Run(fmt.Sprintf("coalesce=%v", coalesce), func(b *testing.B) {
+			h := NewWithOptions(WithCoalesceWrites(coalesce))
+			w := &discardResponseWriter{header: http.Header{}}
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				clear(w.header)
+				h.ServeHTTP(w, req, next)
+			}
+			b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func Benchmark_ServeHTTP_NoCompression(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			benchmarkServeHTTP(b, Default(), "", size)
+		})
+	}
+}
+
+func Benchmark_ServeHTTP_SmallBody(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			benchmarkServeHTTP(b, NewWithOptions(WithMinSize(1<<20)), encodingGzip, size)
+		})
+	}
+}
+
+func Test_ServeHTTP_NoCompressionAllocs(t *testing.T) {
+	gzipHandler := Default()
+	w := &discardResponseWriter{header: http.Header{}}
+	req := httptest.NewRequest("GET", "http://localhost/foobar", nil)
+	next := func(w http.ResponseWriter, r *http.Request) {}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		gzipHandler.ServeHTTP(w, req, next)
+	})
+	if allocs != 0 {
+		t.Errorf("allocs = %v, want 0", allocs)
+	}
+}
+
+func Test_ServeHTTP_AllowCompressionFuncWithStatus(t *testing.T) {
+	gzipHandler := NewWithOptions(WithAllowFuncWithStatus(func(w http.ResponseWriter, r *http.Request, code int) bool {
+		return code < http.StatusInternalServerError
+	}))
+
+	for _, code := range []int{http.StatusOK, http.StatusNotFound, http.StatusInternalServerError, http.StatusBadGateway} {
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(code)
+			rw.Write([]byte(gzipTestString))
+		})
+
+		compressed := w.Header().Get(headerContentEncoding) == encodingGzip
+		if want := code < http.StatusInternalServerError; compressed != want {
+			t.Errorf("%d: compressed = %v, want %v", code, compressed, want)
+		}
+	}
+}
+
+func Test_NewStrict(t *testing.T) {
+	tests := map[int]bool{
+		gzip.HuffmanOnly - 1: false,
+		gzip.HuffmanOnly:     true,
+		DefaultCompression:   true,
+		NoCompression:        true,
+		BestSpeed:            true,
+		BestCompression:      true,
+		BestCompression + 1:  false,
+		11:                   false,
+	}
+
+	for level, valid := range tests {
+		h, err := NewStrict(level, nil)
+		if valid && (err != nil || h == nil) {
+			t.Errorf("level %d: unexpected error %v", level, err)
+		}
+		if !valid && (err == nil || h != nil) {
+			t.Errorf("level %d: expected an error", level)
+		}
+	}
+}
+
+func Test_ServeHTTP_BuggyClient(t *testing.T) {
+	tests := []struct {
+		userAgent  string
+		fn         BuggyClientFunc
+		compressed bool
+	}{
+		{"Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.1)", nil, false},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0", nil, true},
+		{"Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.1)", func(r *http.Request) bool { return false }, true},
+		{"Embedded/1.0", func(r *http.Request) bool { return r.UserAgent() == "Embedded/1.0" }, false},
+	}
+
+	for _, test := range tests {
+		gzipHandler := NewWithOptions(WithBuggyClientFunc(test.fn))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+		req.Header.Set("User-Agent", test.userAgent)
+
+		gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+		if compressed := w.Header().Get(headerContentEncoding) == encodingGzip; compressed != test.compressed {
+			t.Errorf("%q: compressed = %v, want %v", test.userAgent, compressed, test.compressed)
+		}
+	}
+}
+
+func Test_ServeHTTP_Vary(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		handler string
+		want    []string
+	}{
+		{"default", nil, "", []string{headerAcceptEncoding}},
+		{"default appends", nil, "Origin", []string{"Origin", headerAcceptEncoding}},
+		{"default no duplicate", nil, "origin, accept-encoding", []string{"origin, accept-encoding"}},
+		{"no vary", []Option{WithNoVary(true)}, "", nil},
+		{"no vary keeps handler", []Option{WithNoVary(true)}, "Origin", []string{"Origin"}},
+		{"custom", []Option{WithVaryHeaders(headerAcceptEncoding, "Cookie")}, "Origin", []string{"Accept-Encoding, Cookie"}},
+	}
+
+	for _, test := range tests {
+		gzipHandler := NewWithOptions(test.opts...)
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			if test.handler != "" {
+				rw.Header().Set(headerVary, test.handler)
+			}
+			testHTTPContent(rw, r)
+		})
+
+		if w.Header().Get(headerContentEncoding) != encodingGzip {
+			t.Errorf("%s: response is not compressed", test.name)
+		}
+		if got := w.Header().Values(headerVary); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: Vary = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func Test_ServeHTTP_ThreadSafe(t *testing.T) {
+	const goroutines, writes = 8, 200
+	line := strings.Repeat("x", 63) + "\n"
+
+	gzipHandler := NewWithOptions(WithThreadSafe(true), WithMinSize(1024))
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+		var wg sync.WaitGroup
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < writes; j++ {
+					io.WriteString(rw, line)
+					if j%50 == 0 {
+						rw.(http.Flusher).Flush()
+					}
+					// Reading the state races with the writes
+					// without the lock.
+					WasCompressed(rw)
+					grw := rw.(*gzipResponseWriter)
+					grw.Status()
+					grw.BytesWritten()
+					grw.CompressionState()
+				}
+			}()
+		}
+		wg.Wait()
+	})
+
+	if w.Header().Get(headerContentEncoding) != encodingGzip {
+		t.Fatal("response is not compressed")
+	}
+
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gr.Close()
+
+	body, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat(line, goroutines*writes); string(body) != want {
+		t.Errorf("body has %d bytes, want %d", len(body), len(want))
+	}
+}
+
+func Test_ServeHTTP_PrecompressedContent(t *testing.T) {
+	var precompressed bytes.Buffer
+	gz := gzip.NewWriter(&precompressed)
+	gz.Write([]byte(gzipTestString))
+	gz.Close()
+
+	for _, minSize := range []int{0, 1 << 20} {
+		gzipHandler := NewWithOptions(WithMinSize(minSize))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set(headerContentType, "text/plain")
+			rw.Header().Set(headerContentEncoding, encodingGzip)
+			rw.WriteHeader(http.StatusOK)
+			rw.Write(precompressed.Bytes())
+		})
+
+		if got := w.Header().Values(headerContentEncoding); len(got) != 1 || got[0] != encodingGzip {
+			t.Errorf("MinSize %d: Content-Encoding = %q", minSize, got)
+		}
+		if w.Header().Get(headerVary) != "" {
+			t.Errorf("MinSize %d: Vary was set", minSize)
+		}
+		if !bytes.Equal(w.Body.Bytes(), precompressed.Bytes()) {
+			t.Errorf("MinSize %d: body was compressed again", minSize)
+		}
+	}
+}
+
+type closeNotifyRecorder struct {
+	*httptest.ResponseRecorder
+	closed chan bool
+}
+
+func (cr *closeNotifyRecorder) CloseNotify() <-chan bool {
+	return cr.closed
+}
+
+func Test_ServeHTTP_CloseNotify(t *testing.T) {
+	gzipHandler := Default()
+	w := &closeNotifyRecorder{ResponseRecorder: httptest.NewRecorder(), closed: make(chan bool, 1)}
+	w.closed <- true
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+		notifier, ok := w.(http.CloseNotifier)
+		if !ok {
+			t.Fatal("ResponseWriter does not implement http.CloseNotifier")
+		}
+		select {
+		case <-notifier.CloseNotify():
+		case <-time.After(time.Second):
+			t.Error("close notification was not passed on")
+		}
+	})
+}
+
+func Test_ServeHTTP_MaxBytes(t *testing.T) {
+	const maxBytes = 4096
+
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"unbuffered", nil},
+		// The buffers hold back more than the limit, which still counts.
+		{"BufferCompressed", []Option{WithBufferCompressed(true), WithBufferCompressedSize(1 << 20)}},
+		{"CoalesceWrites", []Option{WithCoalesceWrites(true), WithCoalesceSize(1 << 20)}},
+	}
+
+	for _, test := range tests {
+		gzipHandler := NewWithOptions(append(test.opts, WithMaxBytes(maxBytes), WithLevel(NoCompression))...)
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		chunk := bytes.Repeat([]byte("a"), 1024)
+		var writeErr error
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			for i := 0; i < 100 && writeErr == nil; i++ {
+				_, writeErr = rw.Write(chunk)
+			}
+		})
+
+		if writeErr != ErrMaxBytes {
+			t.Errorf("%s: write error = %v, want %v", test.name, writeErr, ErrMaxBytes)
+			continue
+		}
+		if w.Header().Get(headerContentEncoding) != encodingGzip {
+			t.Errorf("%s: response is not compressed", test.name)
+		}
+		// The compressor holds back up to 64KB at NoCompression.
+		if n := w.Body.Len(); n < maxBytes || n > maxBytes+1<<16+len(chunk) {
+			t.Errorf("%s: sent %d bytes, want at most about %d", test.name, n, maxBytes)
+		}
+	}
+}
+
+func Test_ServeHTTP_DetectContentType(t *testing.T) {
+	gzipHandler := NewWithOptions(
+		WithDetectContentType(func(b []byte) string {
+			return "application/json"
+		}),
+		WithCompressibleTypes([]string{"application/json"}),
+	)
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`{"foo":"bar"}`))
+	})
+
+	if got := w.Header().Get(headerContentType); got != "application/json" {
+		t.Errorf("Content-Type = %q, want %q", got, "application/json")
+	}
+	if w.Header().Get(headerContentEncoding) != encodingGzip {
+		t.Error("response is not compressed")
+	}
+}
+
+func Test_ServeHTTP_BufferCompressed(t *testing.T) {
+	large := make([]byte, 4096)
+	for i := range large {
+		large[i] = byte(i * 7919 >> 3)
+	}
+
+	tests := []struct {
+		name          string
+		body          []byte
+		flush         bool
+		contentLength bool
+	}{
+		{"small", []byte(gzipTestString), false, true},
+		{"large", large, false, false},
+		{"flushed", []byte(gzipTestString), true, false},
+	}
+
+	for _, test := range tests {
+		gzipHandler := NewWithOptions(WithBufferCompressed(true), WithBufferCompressedSize(256))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write(test.body)
+			if test.flush {
+				rw.(http.Flusher).Flush()
+			}
+		})
+
+		if w.Header().Get(headerContentEncoding) != encodingGzip {
+			t.Errorf("%s: response is not compressed", test.name)
+		}
+		contentLength := w.Header().Get(headerContentLength)
+		if test.contentLength && contentLength != strconv.Itoa(w.Body.Len()) {
+			t.Errorf("%s: Content-Length = %q, want %d", test.name, contentLength, w.Body.Len())
+		}
+		if !test.contentLength && contentLength != "" {
+			t.Errorf("%s: unexpected Content-Length %q", test.name, contentLength)
+		}
+
+		gr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(gr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, test.body) {
+			t.Errorf("%s: body does not match", test.name)
+		}
+	}
+}
+
+func Test_ServeHTTP_CompressionState(t *testing.T) {
+	tests := map[string]string{
+		"text/plain": "enabled",
+		"image/png":  "disabled",
+	}
+
+	for contentType, want := range tests {
+		gzipHandler := Default()
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			state := rw.(interface{ CompressionState() string })
+			if got := state.CompressionState(); got != "check" {
+				t.Errorf("%s: state before writing = %q, want %q", contentType, got, "check")
+			}
+			rw.Header().Set(headerContentType, contentType)
+			rw.Write([]byte(gzipTestString))
+			if got := state.CompressionState(); got != want {
+				t.Errorf("%s: state = %q, want %q", contentType, got, want)
+			}
+		})
+	}
+}
+
+func Test_ServeHTTP_WebSocketUpgrade(t *testing.T) {
+	tests := []struct {
+		method     string
+		connection string
+		upgrade    string
+		compressed bool
+	}{
+		{"GET", "Upgrade", "websocket", false},
+		{"GET", "keep-alive, upgrade", "WebSocket", false},
+		{"GET", "Upgrade", "h2c", false},
+		{"GET", "", "websocket", true},
+		{"GET", "keep-alive", "", true},
+		{"CONNECT", "", "", false},
+	}
+
+	for _, test := range tests {
+		gzipHandler := Default()
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest(test.method, "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+		if test.connection != "" {
+			req.Header.Set(headerConnection, test.connection)
+		}
+		if test.upgrade != "" {
+			req.Header.Set(headerUpgrade, test.upgrade)
+		}
+
+		gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+		if compressed := w.Header().Get(headerContentEncoding) == encodingGzip; compressed != test.compressed {
+			t.Errorf("%s Connection %q Upgrade %q: compressed = %v, want %v", test.method, test.connection, test.upgrade, compressed, test.compressed)
+		}
+	}
+}
+
+func Test_ServeHTTP_Only2xx(t *testing.T) {
+	tests := map[int]bool{
+		http.StatusOK:                  true,
+		http.StatusCreated:             true,
+		http.StatusMultipleChoices:     false,
+		http.StatusNotFound:            false,
+		http.StatusInternalServerError: false,
+	}
+
+	for code, want := range tests {
+		gzipHandler := NewWithOptions(WithOnly2xx(true))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(code)
+			rw.Write([]byte(gzipTestString))
+		})
+
+		if compressed := w.Header().Get(headerContentEncoding) == encodingGzip; compressed != want {
+			t.Errorf("%d: compressed = %v, want %v", code, compressed, want)
+		}
+		if !want && w.Body.String() != gzipTestString {
+			t.Errorf("%d: body = %q, want %q", code, w.Body.String(), gzipTestString)
+		}
+	}
+}
+
+func Test_ServeHTTP_PooledLevels(t *testing.T) {
+	gzipHandler := NewWithOptions(WithLevelFunc(func(w http.ResponseWriter, r *http.Request) int {
+		level, _ := strconv.Atoi(r.URL.Query().Get("level"))
+		return level
+	}))
+	content := strings.Repeat(gzipTestString, 100)
+
+	levels := []int{BestSpeed, BestCompression, NoCompression, BestSpeed, BestCompression, NoCompression}
+	for round := 0; round < 3; round++ {
+		for _, level := range levels {
+			w := httptest.NewRecorder()
+
+			req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost/foobar?level=%d", level), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+			gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, content)
+			})
+
+			// A writer of the requested level produces exactly these
+			// bytes, a pooled writer of another level would not.
+			var want bytes.Buffer
+			gz, _ := gzip.NewWriterLevel(&want, level)
+			gz.Write([]byte(content))
+			gz.Close()
+			if !bytes.Equal(w.Body.Bytes(), want.Bytes()) {
+				t.Errorf("round %d, level %d: output differs from a new writer", round, level)
+			}
+
+			gr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(gr)
+			if string(body) != content {
+				t.Errorf("round %d, level %d: body mismatch", round, level)
+			}
+		}
+	}
+}
+
+// uncompressedHandler is an http.Handler that opts out of compression by
+// implementing Compression.
+type uncompressedHandler struct{}
+
+func (uncompressedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	testHTTPContent(w, r)
+}
+
+func (uncompressedHandler) AllowCompression(w http.ResponseWriter, r *http.Request) bool {
+	return false
+}
+
+func Test_Wrap(t *testing.T) {
+	tests := map[string]struct {
+		next       http.Handler
+		compressed bool
+	}{
+		"handler func": {http.HandlerFunc(testHTTPContent), true},
+		"compression":  {uncompressedHandler{}, false},
+	}
+
+	for name, test := range tests {
+		mux := http.NewServeMux()
+		mux.Handle("/foobar", Default().Wrap(test.next))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		mux.ServeHTTP(w, req)
+
+		if compressed := w.Header().Get(headerContentEncoding) == encodingGzip; compressed != test.compressed {
+			t.Errorf("%s: compressed = %v, want %v", name, compressed, test.compressed)
+		}
+	}
+}
+
+func Test_ServeHTTP_SniffWindow(t *testing.T) {
+	chunks := []string{"<ht", "ml><head></head><body>", strings.Repeat(gzipTestString, 30), "</body></html>"}
+
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+		for _, chunk := range chunks {
+			io.WriteString(rw, chunk)
+		}
+	})
+
+	if got := w.Header().Get(headerContentType); got != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want %q", got, "text/html; charset=utf-8")
+	}
+	if w.Header().Get(headerContentEncoding) != encodingGzip {
+		t.Error("response is not compressed")
+	}
+	body, err := ReadBody(w.Result())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != strings.Join(chunks, "") {
+		t.Error("body mismatch")
+	}
+}
+
+func Test_ServeHTTP_ResetOnRewrite(t *testing.T) {
+	tests := []struct {
+		name        string
+		reset       bool
+		writeHeader bool
+		flush       bool
+		code        int
+		body        string
+	}{
+		{"ignored", false, true, false, http.StatusOK, "partial" + "error"},
+		{"reset", true, true, false, http.StatusInternalServerError, "error"},
+		{"already sent", true, true, true, http.StatusOK, "partial" + "error"},
+		// A write without WriteHeader starts the response as well.
+		{"ignored implicit", false, false, false, http.StatusOK, "partial" + "error"},
+		{"reset implicit", true, false, false, http.StatusInternalServerError, "error"},
+	}
+
+	for _, test := range tests {
+		gzipHandler := NewWithOptions(WithMinSize(1024), WithResetOnRewrite(test.reset))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set(headerContentType, "text/plain")
+			if test.writeHeader {
+				rw.WriteHeader(http.StatusOK)
+			}
+			io.WriteString(rw, "partial")
+			if test.flush {
+				rw.(http.Flusher).Flush()
+			}
+
+			// An error handler takes over.
+			rw.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(rw, "error")
+		})
+
+		if w.Code != test.code {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.code)
+		}
+		body, err := ReadBody(w.Result())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != test.body {
+			t.Errorf("%s: body = %q, want %q", test.name, body, test.body)
+		}
+	}
+}
+
+func Test_ServeHTTP_AlwaysVary(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		contentType    string
+		alwaysVary     bool
+		want           []string
+	}{
+		{"", "text/plain", false, nil},
+		{"", "text/plain", true, []string{headerAcceptEncoding}},
+		{encodingGzip, "image/png", true, []string{headerAcceptEncoding}},
+		{encodingGzip, "text/plain", true, []string{headerAcceptEncoding}},
+	}
+
+	for _, test := range tests {
+		gzipHandler := NewWithOptions(WithAlwaysVary(test.alwaysVary))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.acceptEncoding != "" {
+			req.Header.Set(headerAcceptEncoding, test.acceptEncoding)
+		}
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set(headerContentType, test.contentType)
+			testHTTPContent(rw, r)
+		})
+
+		if got := w.Header().Values(headerVary); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q %s AlwaysVary %v: Vary = %q, want %q", test.acceptEncoding, test.contentType, test.alwaysVary, got, test.want)
+		}
+	}
+}
+
+func Test_ServeHTTP_NotFound_KeepsContentLength(t *testing.T) {
+	page := "<html><body>" + strings.Repeat("Not Found ", 100) + "</body></html>"
+
+	for _, minSize := range []int{0, 1 << 20} {
+		gzipHandler := NewWithOptions(WithExcludedTypes([]string{"text/html"}), WithMinSize(minSize))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set(headerContentType, "text/html; charset=utf-8")
+			rw.Header().Set(headerContentLength, strconv.Itoa(len(page)))
+			rw.WriteHeader(http.StatusNotFound)
+			io.WriteString(rw, page)
+		})
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("MinSize %d: status = %d, want %d", minSize, w.Code, http.StatusNotFound)
+		}
+		if w.Header().Get(headerContentEncoding) != "" {
+			t.Errorf("MinSize %d: excluded response was compressed", minSize)
+		}
+		if got := w.Header().Get(headerContentLength); got != strconv.Itoa(len(page)) {
+			t.Errorf("MinSize %d: Content-Length = %q, want %d", minSize, got, len(page))
+		}
+		if w.Body.String() != page {
+			t.Errorf("MinSize %d: body mismatch", minSize)
+		}
+	}
+}
+
+// passThroughWriter is a WriteCloser that "compresses" by passing the bytes
+// on unchanged.
+type passThroughWriter struct {
+	io.Writer
+	closed *bool
+}
+
+func (pw passThroughWriter) Close() error {
+	*pw.closed = true
+	return nil
+}
+
+func Test_NewFunc(t *testing.T) {
+	closed := false
+	gzipHandler := NewFunc("fake", func(w io.Writer) (io.WriteCloser, error) {
+		return passThroughWriter{Writer: w, closed: &closed}, nil
+	})
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, "gzip, fake")
+
+	gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+		testHTTPContent(rw, r)
+		rw.(http.Flusher).Flush()
+	})
+
+	if w.Header().Get(headerContentEncoding) != "fake" {
+		t.Errorf("Content-Encoding = %q, want %q", w.Header().Get(headerContentEncoding), "fake")
+	}
+	if w.Body.String() != gzipTestString {
+		t.Errorf("body = %q, want %q", w.Body.String(), gzipTestString)
+	}
+	if !closed {
+		t.Error("writer was not closed")
+	}
+}
+
+func Test_ServeHTTP_SkipMethods(t *testing.T) {
+	gzipHandler := NewWithOptions(WithSkipMethods(http.MethodOptions, http.MethodDelete))
+
+	for method, compressed := range map[string]bool{
+		http.MethodGet:     true,
+		http.MethodPost:    true,
+		http.MethodOptions: false,
+		http.MethodDelete:  false,
+	} {
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest(method, "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+		if (w.Header().Get(headerContentEncoding) == encodingGzip) != compressed {
+			t.Errorf("%s: compressed = %v, want %v", method, !compressed, compressed)
+		}
+		if !compressed && w.Body.String() != gzipTestString {
+			t.Errorf("%s: body = %q, want %q", method, w.Body.String(), gzipTestString)
+		}
+	}
+}
+
+func Test_ServeHTTP_Deterministic(t *testing.T) {
+	gzipHandler := Default()
+	content := strings.Repeat(gzipTestString, 100)
+
+	var outputs [][]byte
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			io.WriteString(rw, content)
+		})
+		outputs = append(outputs, w.Body.Bytes())
+
+		gr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 255 is the OS byte for an unknown operating system.
+		if !gr.ModTime.IsZero() || gr.OS != 255 {
+			t.Errorf("header ModTime = %v, OS = %d", gr.ModTime, gr.OS)
+		}
+	}
+
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Error("compressing the same body twice gave different output")
+	}
+}
+
+func Test_ServeHTTP_WriteAfterClose(t *testing.T) {
+	for _, threadSafe := range []bool{false, true} {
+		gzipHandler := NewWithOptions(WithThreadSafe(threadSafe))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		var leaked http.ResponseWriter
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			leaked = rw
+			testHTTPContent(rw, r)
+		})
+		sent := w.Body.Len()
+
+		// A goroutine the handler leaked writes after it returned.
+		done := make(chan error)
+		go func() {
+			_, err := leaked.Write([]byte(gzipTestString))
+			leaked.(http.Flusher).Flush()
+			done <- err
+		}()
+
+		if err := <-done; err != ErrWriteAfterClose {
+			t.Errorf("ThreadSafe %v: late write error = %v, want %v", threadSafe, err, ErrWriteAfterClose)
+		}
+		if w.Body.Len() != sent {
+			t.Errorf("ThreadSafe %v: late write reached the response", threadSafe)
+		}
+	}
+}
+
+func Test_ServeHTTP_WriteAfterNextRequest(t *testing.T) {
+	for _, threadSafe := range []bool{false, true} {
+		gzipHandler := NewWithOptions(WithThreadSafe(threadSafe))
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		var leaked http.ResponseWriter
+		gzipHandler.ServeHTTP(httptest.NewRecorder(), req, func(rw http.ResponseWriter, r *http.Request) {
+			leaked = rw
+			rw.Write([]byte("first"))
+		})
+
+		// The writer leaked by the first request writes while the second
+		// one is being served.
+		var lateErr error
+		w := httptest.NewRecorder()
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("second"))
+			_, lateErr = leaked.Write([]byte(" leaked"))
+		})
+
+		if lateErr != ErrWriteAfterClose {
+			t.Errorf("ThreadSafe %v: late write error = %v, want %v", threadSafe, lateErr, ErrWriteAfterClose)
+		}
+		body, err := ReadBody(w.Result())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "second" {
+			t.Errorf("ThreadSafe %v: body = %q, want %q", threadSafe, body, "second")
+		}
+	}
+}
+
+func Test_ServeHTTP_SetCompression(t *testing.T) {
+	var precompressed bytes.Buffer
+	gz := gzip.NewWriter(&precompressed)
+	gz.Write([]byte(gzipTestString))
+	gz.Close()
+
+	tests := []struct {
+		name       string
+		header     map[string]string
+		code       int
+		body       string
+		enabled    bool
+		compressed bool
+	}{
+		{"disable", map[string]string{headerContentType: "text/plain"}, http.StatusOK, gzipTestString, false, false},
+		{"enable small excluded", map[string]string{headerContentType: "image/png"}, http.StatusOK, gzipTestString, true, true},
+		{"enable partial content", map[string]string{headerContentType: "text/plain", headerContentRange: "bytes 0-25/100"}, http.StatusPartialContent, gzipTestString, true, false},
+		{"enable no-transform", map[string]string{headerContentType: "text/plain", headerCacheControl: "no-transform"}, http.StatusOK, gzipTestString, true, false},
+		// The body stays encoded once, by the handler.
+		{"enable already encoded", map[string]string{headerContentType: "text/plain", headerContentEncoding: encodingGzip}, http.StatusOK, precompressed.String(), true, true},
+	}
+
+	for _, test := range tests {
+		gzipHandler := NewWithOptions(WithMinSize(1024))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			c := rw.(interface{ SetCompression(bool) error })
+			if err := c.SetCompression(test.enabled); err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			for name, value := range test.header {
+				rw.Header().Set(name, value)
+			}
+			rw.WriteHeader(test.code)
+			io.WriteString(rw, test.body)
+			rw.(http.Flusher).Flush()
+			if err := c.SetCompression(!test.enabled); err == nil {
+				t.Errorf("%s: SetCompression succeeded after the body was sent", test.name)
+			}
+		})
+
+		if compressed := w.Header().Get(headerContentEncoding) == encodingGzip; compressed != test.compressed {
+			t.Errorf("%s: compressed = %v, want %v", test.name, compressed, test.compressed)
+		}
+		body, err := ReadBody(w.Result())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != gzipTestString {
+			t.Errorf("%s: body = %q, want %q", test.name, body, gzipTestString)
+		}
+	}
+}
+
+func Test_ServeHTTP_Levels(t *testing.T) {
+	content := strings.Repeat(gzipTestString, 100)
+	levels := []int{gzip.HuffmanOnly, DefaultCompression, NoCompression, BestSpeed, 2, 3, 4, 5, 6, 7, 8, BestCompression}
+
+	for _, level := range levels {
+		gzipHandler := New(level, nil)
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			io.WriteString(rw, content)
+		})
+
+		if w.Header().Get(headerContentEncoding) != encodingGzip {
+			t.Errorf("level %d: response is not compressed", level)
+			continue
+		}
+		body, err := ReadBody(w.Result())
+		if err != nil {
+			t.Errorf("level %d: %v", level, err)
+		}
+		if string(body) != content {
+			t.Errorf("level %d: body mismatch", level)
+		}
+		// NoCompression stores the body, every other level shrinks it.
+		if stored := w.Body.Len() > len(content); stored != (level == NoCompression) {
+			t.Errorf("level %d: %d compressed bytes for %d bytes of content", level, w.Body.Len(), len(content))
+		}
+	}
+}
+
+func Test_ServeHTTP_PeekFirstWrite(t *testing.T) {
+	large := strings.Repeat(gzipTestString, 100)
+
+	tests := []struct {
+		name       string
+		peek       bool
+		writes     []string
+		compressed bool
+	}{
+		{"single write small", true, []string{gzipTestString}, false},
+		{"single write large", true, []string{large}, true},
+		{"streaming", true, []string{gzipTestString, gzipTestString, gzipTestString}, true},
+		{"streaming without peek", false, []string{gzipTestString, gzipTestString, gzipTestString}, false},
+	}
+
+	for _, test := range tests {
+		gzipHandler := NewWithOptions(WithMinSize(1024), WithPeekFirstWrite(test.peek))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		var decided bool
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set(headerContentType, "text/plain")
+			for _, s := range test.writes {
+				io.WriteString(rw, s)
+			}
+			decided = rw.(*gzipResponseWriter).status != COMPRESSION_CHECK
+		})
+
+		if compressed := w.Header().Get(headerContentEncoding) == encodingGzip; compressed != test.compressed {
+			t.Errorf("%s: compressed = %v, want %v", test.name, compressed, test.compressed)
+		}
+		// A streamed body must not wait for MinSize.
+		if test.peek && len(test.writes) > 1 && !decided {
+			t.Errorf("%s: decision held back for a streamed body", test.name)
+		}
+		body, err := ReadBody(w.Result())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != strings.Join(test.writes, "") {
+			t.Errorf("%s: body mismatch", test.name)
+		}
+	}
+}
+
+func Test_ServeHTTP_ResponseController(t *testing.T) {
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+		if _, ok := rw.(interface{ Unwrap() http.ResponseWriter }); !ok {
+			t.Error("ResponseWriter does not implement Unwrap")
+		}
+		rw.Header().Set(headerContentType, "text/plain")
+		testHTTPContent(rw, r)
+		if err := http.NewResponseController(rw).Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if !w.Flushed || w.Body.Len() == 0 {
+			t.Error("Flush did not reach the client")
+		}
+	})
+
+	body, err := ReadBody(w.Result())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != gzipTestString {
+		t.Errorf("body = %q, want %q", body, gzipTestString)
+	}
+}
+
+func Test_ServeHTTP_Unwrap(t *testing.T) {
+	gzipHandler := Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gzipHandler.ServeHTTP(w, r, func(rw http.ResponseWriter, r *http.Request) {
+			if _, ok := rw.(interface{ Unwrap() http.ResponseWriter }).Unwrap().(negroni.ResponseWriter); ok {
+				t.Error("Unwrap returned the negroni.ResponseWriter")
+			}
+			// Only the ResponseWriter of net/http supports it.
+			if err := http.NewResponseController(rw).EnableFullDuplex(); err != nil {
+				t.Errorf("EnableFullDuplex = %v", err)
+			}
+			testHTTPContent(rw, r)
+		})
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ReadBody(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != gzipTestString {
+		t.Errorf("body = %q, want %q", body, gzipTestString)
+	}
+}
+
+// readFromRecorder is a ResponseRecorder that also implements io.ReaderFrom.
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	copied int64
+}
+
+func (rr *readFromRecorder) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(rr.ResponseRecorder, r)
+	rr.copied += n
+	return n, err
+}
+
+func Test_ServeHTTP_ReadFromOriginal(t *testing.T) {
+	content := "<html>" + strings.Repeat(gzipTestString, 100) + "</html>"
+
+	var stats Stats
+	gzipHandler := NewWithOptions(
+		WithAllowFunc(func(w http.ResponseWriter, r *http.Request) bool { return false }),
+		WithOnComplete(func(s Stats) { stats = s }),
+	)
+	w := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+		// Hide the WriteTo of strings.Reader, so io.Copy uses ReadFrom.
+		io.Copy(w, struct{ io.Reader }{strings.NewReader(content)})
+	})
+
+	// The first read goes through Write for the compression decision.
+	if w.copied != int64(len(content)-sniffLen) {
+		t.Errorf("ReadFrom copied %d bytes, want %d", w.copied, len(content)-sniffLen)
+	}
+	if w.Body.String() != content {
+		t.Error("body mismatch")
+	}
+	if stats.CompressedBytes != int64(len(content)) {
+		t.Errorf("CompressedBytes = %d, want %d", stats.CompressedBytes, len(content))
+	}
+}
+
+// deadlineResponseWriter is a negroni.ResponseWriter that records the
+// deadlines set on it.
+type deadlineResponseWriter struct {
+	negroni.ResponseWriter
+	read, write time.Time
+}
+
+func (dw *deadlineResponseWriter) SetReadDeadline(deadline time.Time) error {
+	dw.read = deadline
+	return nil
+}
+
+func (dw *deadlineResponseWriter) SetWriteDeadline(deadline time.Time) error {
+	dw.write = deadline
+	return nil
+}
+
+func Test_ResponseWriter_Deadlines(t *testing.T) {
+	h := Default()
+	req := httptest.NewRequest("GET", "http://localhost/foobar", nil)
+	deadline := time.Now().Add(time.Minute)
+
+	dw := &deadlineResponseWriter{ResponseWriter: negroni.NewResponseWriter(httptest.NewRecorder())}
+	grw := newResponseWriter(h, dw, dw, req, encodingGzip)
+
+	rc := http.NewResponseController(grw)
+	if err := rc.SetReadDeadline(deadline); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil {
+		t.Fatal(err)
+	}
+	if !dw.read.Equal(deadline) || !dw.write.Equal(deadline) {
+		t.Errorf("deadlines = %v, %v, want %v", dw.read, dw.write, deadline)
+	}
+
+	nrw := negroni.NewResponseWriter(httptest.NewRecorder())
+	grw = newResponseWriter(h, nrw, nrw, req, encodingGzip)
+	if err := grw.SetReadDeadline(deadline); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("SetReadDeadline = %v, want http.ErrNotSupported", err)
+	}
+	if err := grw.SetWriteDeadline(deadline); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("SetWriteDeadline = %v, want http.ErrNotSupported", err)
+	}
+}
+
+func Test_ServeHTTP_DeadlinesServer(t *testing.T) {
+	gzipHandler := Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gzipHandler.ServeHTTP(w, r, func(rw http.ResponseWriter, r *http.Request) {
+			rc := http.NewResponseController(rw)
+			deadline := time.Now().Add(time.Minute)
+			if err := rc.SetReadDeadline(deadline); err != nil {
+				t.Errorf("SetReadDeadline = %v", err)
+			}
+			if err := rc.SetWriteDeadline(deadline); err != nil {
+				t.Errorf("SetWriteDeadline = %v", err)
+			}
+			testHTTPContent(rw, r)
+		})
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ReadBody(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != gzipTestString {
+		t.Errorf("body = %q, want %q", body, gzipTestString)
+	}
+}
+
+func Test_ServeHTTP_AllowFuncE(t *testing.T) {
+	errAllow := errors.New("flag lookup failed")
+	tests := map[string]struct {
+		allow    bool
+		err      error
+		code     int
+		encoding string
+	}{
+		"allow":    {true, nil, http.StatusOK, encodingGzip},
+		"disallow": {false, nil, http.StatusOK, ""},
+		"error":    {true, errAllow, http.StatusInternalServerError, ""},
+	}
+
+	for name, tt := range tests {
+		var reported error
+		gzipHandler := NewWithOptions(
+			WithAllowFuncE(func(w http.ResponseWriter, r *http.Request) (bool, error) {
+				return tt.allow, tt.err
+			}),
+			WithOnError(func(err error) {
+				reported = err
+			}),
+		)
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		var writeErr error
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Handler", "yes")
+			w.Header().Set(headerContentType, "text/plain")
+			_, writeErr = w.Write([]byte(gzipTestString))
+		})
+
+		if w.Code != tt.code {
+			t.Errorf("%s: status = %d, want %d", name, w.Code, tt.code)
+		}
+		if got := w.Header().Get(headerContentEncoding); got != tt.encoding {
+			t.Errorf("%s: Content-Encoding = %q, want %q", name, got, tt.encoding)
+		}
+		if writeErr != tt.err || reported != tt.err {
+			t.Errorf("%s: write error %v and OnError %v, want %v", name, writeErr, reported, tt.err)
+		}
+		if tt.err == nil {
+			continue
+		}
+		if w.Header().Get("X-Handler") != "" {
+			t.Errorf("%s: handler headers were sent with the error", name)
+		}
+		if strings.Contains(w.Body.String(), gzipTestString) {
+			t.Errorf("%s: handler body was sent with the error: %q", name, w.Body.String())
+		}
+	}
+}
+
+func Test_ServeHTTP_AutoFlushNDJSON(t *testing.T) {
+	gzipHandler := Default()
+	records := []string{`{"id":1}` + "\n", `{"id":2}` + "\n", `{"id":3}` + "\n"}
+	read := make(chan struct{})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gzipHandler.ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerContentType, "application/x-ndjson")
+			for _, record := range records {
+				fmt.Fprint(w, record)
+				// Deadlocks unless the record was flushed.
+				select {
+				case <-read:
+				case <-time.After(5 * time.Second):
+					t.Error("timed out waiting for the client")
+					return
+				}
+			}
+		})
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get(headerContentEncoding) != encodingGzip {
+		t.Fatal("response is not compressed")
+	}
+
+	gr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(gr)
+	for _, record := range records {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != record {
+			t.Errorf("read %q, want %q", line, record)
+		}
+		read <- struct{}{}
+	}
+}
+
+func Test_ServeHTTP_WriteHeaderWithoutBody(t *testing.T) {
+	tests := []struct {
+		contentType string
+		flush       bool
+	}{
+		{"text/plain", false},
+		// Without a Content-Type the Flush leaves the decision to the
+		// body, and there is none.
+		{"", true},
+	}
+
+	for _, test := range tests {
+		gzipHandler := Default()
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			if test.contentType != "" {
+				rw.Header().Set(headerContentType, test.contentType)
+			}
+			rw.WriteHeader(http.StatusOK)
+			rw.Write(nil)
+			if test.flush {
+				rw.(http.Flusher).Flush()
+			}
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("flush %v: status = %d, want %d", test.flush, w.Code, http.StatusOK)
+		}
+		if w.Header().Get(headerContentEncoding) != "" {
+			t.Errorf("flush %v: Content-Encoding = %q for an empty body", test.flush, w.Header().Get(headerContentEncoding))
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("flush %v: body = %q, want none", test.flush, w.Body.String())
+		}
+	}
+}
+
+func Test_ServeHTTP_FlushHeaders(t *testing.T) {
+	tests := []struct {
+		contentType string
+		compressed  bool
+	}{
+		{"text/event-stream", false},
+		{"application/json", true},
+	}
+
+	for _, test := range tests {
+		gzipHandler := Default()
+		release := make(chan struct{})
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gzipHandler.ServeHTTP(w, r, func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Set(headerContentType, test.contentType)
+				rw.WriteHeader(http.StatusOK)
+				if !rw.(negroni.ResponseWriter).Written() {
+					t.Errorf("%s: Written() = false after WriteHeader", test.contentType)
+				}
+				rw.(http.Flusher).Flush()
+				// The client has to get the headers before the body.
+				<-release
+				testHTTPContent(rw, r)
+			})
+		}))
+
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Do(req)
+		close(release)
+		if err != nil {
+			ts.Close()
+			t.Fatalf("%s: %v", test.contentType, err)
+		}
+		if compressed := resp.Header.Get(headerContentEncoding) == encodingGzip; compressed != test.compressed {
+			t.Errorf("%s: compressed = %v, want %v", test.contentType, compressed, test.compressed)
+		}
+		body, err := ReadBody(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != gzipTestString {
+			t.Errorf("%s: body = %q, want %q", test.contentType, body, gzipTestString)
+		}
+		ts.Close()
+	}
+}
+
+func Test_ServeHTTP_FlushBeforeWrite(t *testing.T) {
+	png := "\x89PNG\x0D\x0A\x1A\x0A" + strings.Repeat(gzipTestString, 100)
+
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+		rw.(http.Flusher).Flush()
+		io.WriteString(rw, png)
+	})
+
+	// The type is still detected from the body written after the Flush.
+	if ct := w.Header().Get(headerContentType); ct != "image/png" {
+		t.Errorf("Content-Type = %q, want %q", ct, "image/png")
+	}
+	if w.Header().Get(headerContentEncoding) != "" {
+		t.Error("PNG body was compressed")
+	}
+	if w.Body.String() != png {
+		t.Error("body mismatch")
+	}
+}
+
+func Test_ServeHTTP_AcceptEncodingHeader(t *testing.T) {
+	gzipHandler := NewWithOptions(WithAcceptEncodingHeader("X-Accept-Encoding"))
+
+	for header, encoding := range map[string]string{
+		"X-Accept-Encoding":  encodingGzip,
+		headerAcceptEncoding: "",
+	} {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(header, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+		if got := w.Header().Get(headerContentEncoding); got != encoding {
+			t.Errorf("%s: Content-Encoding = %q, want %q", header, got, encoding)
+		}
+		body, err := ReadBody(w.Result())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != gzipTestString {
+			t.Errorf("%s: body = %q, want %q", header, body, gzipTestString)
+		}
+	}
+}
+
+func Test_ServeHTTP_BytesWritten(t *testing.T) {
+	// The image is excluded from compression and written as is.
+	for _, contentType := range []string{"text/plain", "image/png"} {
+		gzipHandler := Default()
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set(headerContentType, contentType)
+			fmt.Fprint(rw, strings.Repeat(gzipTestString, 100))
+			rw.(http.Flusher).Flush()
+
+			written := rw.(interface{ BytesWritten() int64 }).BytesWritten()
+			if written == 0 || written != int64(w.Body.Len()) {
+				t.Errorf("%s: BytesWritten() = %d, want %d", contentType, written, w.Body.Len())
+			}
+		})
+	}
+}
+
+func Test_ServeHTTP_NoTransform(t *testing.T) {
+	for cacheControl, compressed := range map[string]bool{
+		"no-transform":           false,
+		"public, No-Transform":   false,
+		"public, max-age=3600":   true,
+		"no-transformation-hint": true,
+	} {
+		gzipHandler := Default()
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerCacheControl, cacheControl)
+			testHTTPContent(w, r)
+		})
+
+		if (w.Header().Get(headerContentEncoding) == encodingGzip) != compressed {
+			t.Errorf("Cache-Control %q: wrong Content-Encoding %q", cacheControl, w.Header().Get(headerContentEncoding))
+		}
+		body, err := ReadBody(w.Result())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != gzipTestString {
+			t.Errorf("Cache-Control %q: body = %q", cacheControl, body)
+		}
+	}
+}
+
+func Test_ServeHTTP_DisableHeader(t *testing.T) {
+	tests := []struct {
+		name, value string
+		header      string
+		compressed  bool
+	}{
+		{"X-No-Compress", "", "1", false},
+		{"X-No-Compress", "", "", true},
+		{"X-No-Compress", "1", "1", false},
+		{"X-No-Compress", "true", "TRUE", false},
+		{"X-No-Compress", "1", "0", true},
+	}
+
+	for _, test := range tests {
+		gzipHandler := NewWithOptions(WithDisableHeader(test.name, test.value))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+		if test.header != "" {
+			req.Header.Set(test.name, test.header)
+		}
+
+		gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+		if (w.Header().Get(headerContentEncoding) == encodingGzip) != test.compressed {
+			t.Errorf("%s: %q with value %q: wrong Content-Encoding %q", test.name, test.header, test.value, w.Header().Get(headerContentEncoding))
+		}
+		if !test.compressed && w.Body.String() != gzipTestString {
+			t.Errorf("%s: %q: body = %q, want %q", test.name, test.header, w.Body.String(), gzipTestString)
+		}
+	}
+}
+
+// flushCountRecorder is a ResponseRecorder that counts calls to Flush.
+type flushCountRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (fr *flushCountRecorder) Flush() {
+	fr.flushes++
+	fr.ResponseRecorder.Flush()
+}
+
+func Test_ServeHTTP_FlushThreshold(t *testing.T) {
+	for threshold, flushes := range map[int]int{
+		0:    0,
+		1000: 10,
+		2500: 4,
+	} {
+		gzipHandler := NewWithOptions(WithFlushThreshold(threshold))
+		w := &flushCountRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		chunk := strings.Repeat("A", 100)
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerContentType, "text/plain")
+			for i := 0; i < 100; i++ {
+				fmt.Fprint(w, chunk)
+			}
+		})
+
+		if w.flushes != flushes {
+			t.Errorf("FlushThreshold %d: %d flushes, want %d", threshold, w.flushes, flushes)
+		}
+		body, err := ReadBody(w.Result())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != strings.Repeat(chunk, 100) {
+			t.Errorf("FlushThreshold %d: wrong body", threshold)
+		}
+	}
+}
+
+func Test_ServeHTTP_EarlyHints(t *testing.T) {
+	gzipHandler := Default()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gzipHandler.ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+			w.WriteHeader(http.StatusEarlyHints)
+			w.WriteHeader(http.StatusOK)
+			testHTTPContent(w, r)
+		})
+	}))
+	defer ts.Close()
+
+	var hints []int
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			hints = append(hints, code)
+			if header.Get(headerContentEncoding) != "" {
+				t.Errorf("%d response has Content-Encoding %q", code, header.Get(headerContentEncoding))
+			}
+			return nil
+		},
+	}
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if !reflect.DeepEqual(hints, []int{http.StatusEarlyHints}) {
+		t.Errorf("informational responses = %v, want [103]", hints)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp.Header.Get(headerContentEncoding) != encodingGzip {
+		t.Errorf("Content-Encoding = %q, want %q", resp.Header.Get(headerContentEncoding), encodingGzip)
+	}
+	body, err := ReadBody(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != gzipTestString {
+		t.Errorf("body = %q, want %q", body, gzipTestString)
+	}
+}
+
+func Test_ServeHTTP_H2CUpgrade(t *testing.T) {
+	var reasons []string
+	gzipHandler := NewWithOptions(WithOnSkip(func(r *http.Request, reason string) {
+		reasons = append(reasons, reason)
+	}))
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+	req.Header.Set(headerConnection, "Upgrade, HTTP2-Settings")
+	req.Header.Set(headerUpgrade, "h2c")
+	req.Header.Set("HTTP2-Settings", "AAMAAABkAARAAAAAAAIAAAAA")
+
+	gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+		if _, ok := rw.(*gzipResponseWriter); ok {
+			t.Error("ResponseWriter was wrapped for a protocol upgrade")
+		}
+		testHTTPContent(rw, r)
+	})
+
+	if w.Header().Get(headerContentEncoding) != "" {
+		t.Errorf("Content-Encoding = %q, want none", w.Header().Get(headerContentEncoding))
+	}
+	if !reflect.DeepEqual(reasons, []string{"protocol upgrade"}) {
+		t.Errorf("skip reasons = %v, want [protocol upgrade]", reasons)
+	}
+}
+
+func Test_ServeHTTP_CacheableOnly(t *testing.T) {
+	for cacheControl, compressed := range map[string]bool{
+		"":                          true,
+		"public, max-age=3600":      true,
+		"private":                   false,
+		"no-store":                  false,
+		"max-age=0, Private":        false,
+		`private="Set-Cookie"`:      true,
+		"public, no-store, max-age": false,
+	} {
+		gzipHandler := NewWithOptions(WithCacheableOnly(true))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			if cacheControl != "" {
+				w.Header().Set(headerCacheControl, cacheControl)
+			}
+			testHTTPContent(w, r)
+		})
+
+		if (w.Header().Get(headerContentEncoding) == encodingGzip) != compressed {
+			t.Errorf("Cache-Control %q: wrong Content-Encoding %q", cacheControl, w.Header().Get(headerContentEncoding))
+		}
+	}
+}
+
+func Test_ServeHTTP_SkipTransferEncoding(t *testing.T) {
+	for skip, compressed := range map[bool]bool{false: true, true: false} {
+		gzipHandler := NewWithOptions(WithSkipTransferEncoding(skip))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerTransferEncoding, "chunked")
+			testHTTPContent(w, r)
+		})
+
+		if (w.Header().Get(headerContentEncoding) == encodingGzip) != compressed {
+			t.Errorf("SkipTransferEncoding %v: wrong Content-Encoding %q", skip, w.Header().Get(headerContentEncoding))
+		}
+		body, err := ReadBody(w.Result())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != gzipTestString {
+			t.Errorf("SkipTransferEncoding %v: body = %q", skip, body)
+		}
+	}
+}
+
+func Test_ServeHTTP_OnCompleteLabel(t *testing.T) {
+	var labels []string
+	onComplete := WithOnComplete(func(s Stats) {
+		labels = append(labels, s.Label)
+	})
+
+	for _, gzipHandler := range []*handler{
+		NewWithOptions(onComplete, WithLabel("api")),
+		NewWithOptions(onComplete),
+	} {
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(httptest.NewRecorder(), req, testHTTPContent)
+	}
+
+	if !reflect.DeepEqual(labels, []string{"api", ""}) {
+		t.Errorf("labels = %q, want [\"api\" \"\"]", labels)
+	}
+}
+
+func Test_ServeHTTP_NegroniResponseWriter(t *testing.T) {
+	var stats Stats
+	gzipHandler := NewWithOptions(WithOnComplete(func(s Stats) {
+		stats = s
+	}))
+	w := httptest.NewRecorder()
+	nrw := negroni.NewResponseWriter(w)
+	// Bytes written before the handler are not counted.
+	prefix := "prefix"
+	fmt.Fprint(nrw, prefix)
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(nrw, req, func(rw http.ResponseWriter, r *http.Request) {
+		if rw.(*gzipResponseWriter).ResponseWriter != nrw {
+			t.Error("negroni.ResponseWriter was wrapped again")
+		}
+		testHTTPContent(rw, r)
+	})
+
+	if !stats.Compressed {
+		t.Fatal("response was not compressed")
+	}
+	if want := int64(w.Body.Len() - len(prefix)); stats.CompressedBytes != want {
+		t.Errorf("CompressedBytes = %d, want %d", stats.CompressedBytes, want)
+	}
+	body, err := ReadBody(&http.Response{
+		Header: w.Header(),
+		Body:   io.NopCloser(strings.NewReader(strings.TrimPrefix(w.Body.String(), prefix))),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != gzipTestString {
+		t.Errorf("body = %q, want %q", body, gzipTestString)
+	}
+}
+
+func Test_ServeHTTP_SniffCompressibility(t *testing.T) {
+	random := make([]byte, 2048)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := []byte(strings.Repeat(gzipTestString+" ", 100))
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		compressed  bool
+	}{
+		{"random", "", random, false},
+		{"random octet-stream", "application/octet-stream", random, false},
+		{"random typed", "text/plain", random, true},
+		{"text octet-stream", "application/octet-stream", text, true},
+	}
+
+	for _, test := range tests {
+		gzipHandler := NewWithOptions(WithSniffCompressibility(true))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			if test.contentType != "" {
+				w.Header().Set(headerContentType, test.contentType)
+			}
+			w.Write(test.body)
+		})
+
+		if (w.Header().Get(headerContentEncoding) == encodingGzip) != test.compressed {
+			t.Errorf("%s: wrong Content-Encoding %q", test.name, w.Header().Get(headerContentEncoding))
+		}
+		body, err := ReadBody(w.Result())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, test.body) {
+			t.Errorf("%s: wrong body", test.name)
+		}
+	}
+}
+
+// writeCountRecorder is a ResponseRecorder that counts calls to Write.
+type writeCountRecorder struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (wr *writeCountRecorder) Write(b []byte) (int, error) {
+	wr.writes++
+	return wr.ResponseRecorder.Write(b)
+}
+
+func Test_ServeHTTP_CoalesceWrites(t *testing.T) {
+	random := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	writes := map[bool]int{}
+
+	for _, coalesce := range []bool{false, true} {
+		gzipHandler := NewWithOptions(WithCoalesceWrites(coalesce), WithCoalesceSize(16<<10))
+		w := &writeCountRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set(headerContentType, "text/plain")
+			rw.Write(random[:len(random)/2])
+			rw.(http.Flusher).Flush()
+			if w.Body.Len() == 0 {
+				t.Errorf("CoalesceWrites %v: Flush did not write out the body", coalesce)
+			}
+			rw.Write(random[len(random)/2:])
+		})
+		writes[coalesce] = w.writes
+
+		body, err := ReadBody(w.Result())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, random) {
+			t.Errorf("CoalesceWrites %v: wrong body", coalesce)
+		}
+	}
+
+	// About 64KB of compressed output in writes of 16KB, and one more for
+	// each flush.
+	if writes[true] > 6 || writes[true] >= writes[false] {
+		t.Errorf("%d writes coalesced, %d without", writes[true], writes[false])
+	}
+}
+
+func Test_ServeHTTP_DebugHeaders(t *testing.T) {
+	tests := map[string]struct {
+		path           string
+		acceptEncoding string
+		contentType    string
+		minSize        int
+		empty          bool
+		reason         string
+	}{
+		"compressed":           {"/foobar", encodingGzip, "text/plain", 0, false, ""},
+		"no accept encoding":   {"/foobar", "", "text/plain", 0, false, "no accepted encoding"},
+		"excluded path":        {"/metrics", encodingGzip, "text/plain", 0, false, "excluded path"},
+		"excluded type":        {"/foobar", encodingGzip, "image/png", 0, false, "content type excluded"},
+		"below min size":       {"/foobar", encodingGzip, "text/plain", 1024, false, "body below minimum size"},
+		"event stream":         {"/foobar", encodingGzip, "text/event-stream", 0, false, "event stream"},
+		"empty body":           {"/foobar", encodingGzip, "text/plain", 0, true, "empty body"},
+		"empty body, min size": {"/foobar", encodingGzip, "text/plain", 1024, true, "empty body"},
+		"Content-Length":       {"/foobar", encodingGzip, "text/plain", 1024, false, "body below minimum size"},
+	}
+
+	for name, test := range tests {
+		gzipHandler := NewWithOptions(
+			WithDebugHeaders(true),
+			WithExcludedPaths("/metrics"),
+			WithMinSize(test.minSize),
+		)
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost"+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.acceptEncoding != "" {
+			req.Header.Set(headerAcceptEncoding, test.acceptEncoding)
+		}
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerContentType, test.contentType)
+			if name == "Content-Length" {
+				// The size is known before the body is written.
+				w.Header().Set(headerContentLength, strconv.Itoa(len(gzipTestString)))
+			}
+			if !test.empty {
+				testHTTPContent(w, r)
+			}
+		})
+
+		if got := w.Result().Header.Get(headerGzipSkipped); got != test.reason {
+			t.Errorf("%s: X-Gzip-Skipped = %q, want %q", name, got, test.reason)
+		}
+	}
+}
+
+func Test_ServeHTTP_DebugHeadersOff(t *testing.T) {
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gzipHandler.ServeHTTP(w, req, testHTTPContent)
+
+	if _, ok := w.Header()[headerGzipSkipped]; ok {
+		t.Error("X-Gzip-Skipped was set without DebugHeaders")
+	}
+}
+
+func Test_ServeHTTP_GRPCWeb(t *testing.T) {
+	// A gRPC-Web data frame: flag, length and message.
+	frame := "\x00\x00\x00\x00\x15" + gzipTestString
+
+	contentTypes := []string{
+		"application/grpc",
+		"application/grpc+proto",
+		"application/grpc+json",
+		"application/grpc-web",
+		"application/grpc-web+proto",
+		"application/grpc-web+json",
+		"application/grpc-web+thrift",
+		"application/grpc-web-text",
+		"application/grpc-web-text+proto",
+		"application/grpc-web-text+json",
+	}
+	for _, contentType := range contentTypes {
+		gzipHandler := Default()
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("POST", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerContentType, contentType)
+			fmt.Fprint(w, frame)
+		})
+
+		if w.Header().Get(headerContentEncoding) != "" {
+			t.Errorf("%s: Content-Encoding = %q, want none", contentType, w.Header().Get(headerContentEncoding))
+		}
+		if w.Body.String() != frame {
+			t.Errorf("%s: body = %q, want %q", contentType, w.Body.String(), frame)
+		}
+	}
+}
+
+func Test_ServeHTTP_ShouldCompressStatus(t *testing.T) {
+	only404 := func(code int) bool {
+		return code == http.StatusNotFound
+	}
+	tests := []struct {
+		shouldCompress func(int) bool
+		code           int
+		compressed     bool
+	}{
+		{nil, http.StatusOK, true},
+		{nil, http.StatusMovedPermanently, false},
+		{nil, http.StatusFound, false},
+		{nil, http.StatusTemporaryRedirect, false},
+		{nil, http.StatusNotFound, true},
+		{only404, http.StatusOK, false},
+		{only404, http.StatusNotFound, true},
+		{only404, http.StatusNoContent, false},
+	}
+
+	for _, test := range tests {
+		gzipHandler := NewWithOptions(WithShouldCompressStatus(test.shouldCompress))
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerContentType, "text/html")
+			if test.code >= 300 && test.code < 400 {
+				http.Redirect(w, r, "/elsewhere", test.code)
+				return
+			}
+			w.WriteHeader(test.code)
+			if bodyAllowed(test.code) {
+				fmt.Fprint(w, gzipTestString)
+			}
+		})
+
+		if w.Code != test.code {
+			t.Errorf("status = %d, want %d", w.Code, test.code)
+		}
+		if (w.Header().Get(headerContentEncoding) == encodingGzip) != test.compressed {
+			t.Errorf("custom %v, status %d: wrong Content-Encoding %q", test.shouldCompress != nil, test.code, w.Header().Get(headerContentEncoding))
+		}
+	}
+}
+
+func Test_ServeHTTP_AlwaysDetectContentType(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		minSize        int
+		reason         string
+	}{
+		{"", 0, "no accepted encoding"},
+		{encodingGzip, 1024, "body below minimum size"},
+	}
+
+	for _, test := range tests {
+		var reasons []string
+		gzipHandler := NewWithOptions(
+			WithAlwaysDetectContentType(true),
+			WithMinSize(test.minSize),
+			WithOnSkip(func(r *http.Request, reason string) {
+				reasons = append(reasons, reason)
+			}),
+		)
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.acceptEncoding != "" {
+			req.Header.Set(headerAcceptEncoding, test.acceptEncoding)
+		}
+
+		gzipHandler.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, "<html><body>"+gzipTestString+"</body></html>")
+		})
+
+		if w.Header().Get(headerContentEncoding) != "" {
+			t.Errorf("%s: Content-Encoding = %q, want none", test.reason, w.Header().Get(headerContentEncoding))
+		}
+		if got := w.Result().Header.Get(headerContentType); got != "text/html; charset=utf-8" {
+			t.Errorf("%s: Content-Type = %q, want text/html", test.reason, got)
+		}
+		if !reflect.DeepEqual(reasons, []string{test.reason}) {
+			t.Errorf("skip reasons = %v, want [%s]", reasons, test.reason)
+		}
+	}
+}
+
+func Test_ServeHTTP_Abort(t *testing.T) {
+	var completed bool
+	gzipHandler := NewWithOptions(
+		WithOnComplete(func(Stats) { completed = true }),
+		WithOnError(func(err error) { t.Errorf("OnError(%v)", err) }),
+	)
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set(headerContentType, "text/plain")
+		fmt.Fprint(rw, gzipTestString)
+		rw.(http.Flusher).Flush()
+
+		rw.(interface{ Abort() }).Abort()
+		if _, err := fmt.Fprint(rw, gzipTestString); err != ErrAborted {
+			t.Errorf("write after Abort = %v, want ErrAborted", err)
+		}
+		rw.(http.Flusher).Flush()
+	})
+
+	if w.Header().Get(headerContentEncoding) != encodingGzip {
+		t.Fatal("response is not compressed")
+	}
+	if completed {
+		t.Error("OnComplete was called for an aborted response")
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(gr)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("reading the body = %v, want io.ErrUnexpectedEOF as the gzip footer is missing", err)
+	}
+	if string(body) != gzipTestString {
+		t.Errorf("body = %q, want %q", body, gzipTestString)
+	}
+}
+
+func Test_ServeHTTP_AbortBeforeStatus(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		opts        []Option
+	}{
+		// The body is too short to detect its type.
+		{"pending", "", nil},
+		// Compression is decided on, but the body is held back.
+		{"BufferCompressed", "text/plain", []Option{WithBufferCompressed(true)}},
+	}
+
+	for _, test := range tests {
+		gzipHandler := NewWithOptions(test.opts...)
+		w := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+		gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+			if test.contentType != "" {
+				rw.Header().Set(headerContentType, test.contentType)
+			}
+			fmt.Fprint(rw, "partial")
+			if test.contentType != "" && !WasCompressed(rw) {
+				t.Errorf("%s: compression was not decided on", test.name)
+			}
+			rw.(interface{ Abort() }).Abort()
+		})
+
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, http.StatusInternalServerError)
+		}
+		if w.Header().Get(headerContentEncoding) != "" {
+			t.Errorf("%s: Content-Encoding = %q", test.name, w.Header().Get(headerContentEncoding))
+		}
+		if strings.Contains(w.Body.String(), "partial") {
+			t.Errorf("%s: body = %q contains the aborted body", test.name, w.Body.String())
+		}
+	}
+}
+
+func Test_ServeHTTP_SetGzipName(t *testing.T) {
+	gzipHandler := Default()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	type gzipHeaderSetter interface {
+		SetGzipName(string) error
+		SetGzipComment(string) error
+	}
+	gzipHandler.ServeHTTP(w, req, func(rw http.ResponseWriter, r *http.Request) {
+		setter := rw.(gzipHeaderSetter)
+		if err := setter.SetGzipName("report.csv"); err != nil {
+			t.Fatal(err)
+		}
+		if err := setter.SetGzipComment("generated"); err != nil {
+			t.Fatal(err)
+		}
+		rw.Header().Set(headerContentType, "text/csv")
+		testHTTPContent(rw, r)
+		if err := setter.SetGzipName("late.csv"); err == nil {
+			t.Error("SetGzipName succeeded after the stream started")
+		}
+	})
+
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gr.Name != "report.csv" || gr.Comment != "generated" {
+		t.Errorf("gzip header Name %q and Comment %q, want %q and %q", gr.Name, gr.Comment, "report.csv", "generated")
+	}
+	body, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != gzipTestString {
+		t.Errorf("body = %q, want %q", body, gzipTestString)
+	}
+
+	// The name is not carried over to the next response from the pools.
+	w = httptest.NewRecorder()
+	gzipHandler.ServeHTTP(w, req, testHTTPContent)
+	gr, err = gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gr.Name != "" || gr.Comment != "" {
+		t.Errorf("next response has Name %q and Comment %q", gr.Name, gr.Comment)
+	}
+}
@@ -0,0 +1,103 @@
+package gzip
+
+import (
+	"strings"
+)
+
+// mediaTypeEventStream is the media type of Server-Sent Events.
+const mediaTypeEventStream = "text/event-stream"
+
+// streamingMediaTypes lists media types of streams of records, such as
+// Server-Sent Events and newline-delimited JSON. Clients expect every record
+// as soon as it is written, so writes of these types are always flushed.
+var streamingMediaTypes = []string{
+	mediaTypeEventStream,
+	"application/x-ndjson",
+	"application/ndjson",
+	"application/stream+json",
+}
+
+// DefaultExcludedContentTypes lists media types that are already compressed,
+// so compressing them again wastes CPU and usually grows the payload. It is
+// used by handlers whose ExcludedContentTypes is nil, which includes Default.
+// Changes to it apply to all of those handlers, so they should be made before
+// serving requests. WithAdditionalExcludedTypes extends it for one handler.
+var DefaultExcludedContentTypes = []string{
+	"image/gif",
+	"image/jpeg",
+	"image/png",
+	"image/webp",
+	"video/*",
+	"audio/*",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/x-bzip2",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/zstd",
+	"font/woff",
+	"font/woff2",
+	// gRPC frames its messages and compresses them itself, compressing
+	// the stream can break the framing. These also match the types with a
+	// codec suffix, such as application/grpc+proto.
+	"application/grpc",
+	"application/grpc-web",
+	"application/grpc-web-text",
+}
+
+// mediaType returns the lower-cased media type of a Content-Type header
+// value, without any parameters.
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// Results of matchMediaType, from the least to the most specific match.
+const (
+	noMatch = iota - 1
+	anyMatch
+	typeMatch
+	suffixMatch
+	exactMatch
+)
+
+// matchMediaType returns how specifically the Content-Type header value
+// matches the most specific of patterns. A pattern is either a media type, a
+// type with a wildcard subtype such as "image/*", or "*/*". A type followed
+// by just a slash, such as "image/", works like "image/*". A media type with
+// a suffix after a plus sign, such as "application/grpc+json", also matches
+// the media type without it, less specifically than an exact match. Matching
+// ignores parameters and case.
+func matchMediaType(contentType string, patterns []string) int {
+	mt := mediaType(contentType)
+	if mt == "" {
+		return noMatch
+	}
+	typ := mt
+	if i := strings.IndexByte(mt, '/'); i >= 0 {
+		typ = mt[:i]
+	}
+	base := ""
+	if i := strings.IndexByte(mt, '+'); i >= 0 {
+		base = mt[:i]
+	}
+
+	match := noMatch
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == mt:
+			return exactMatch
+		case pattern == base:
+			match = max(match, suffixMatch)
+		case pattern == "*/*":
+			match = max(match, anyMatch)
+		case pattern == typ+"/*" || pattern == typ+"/":
+			match = max(match, typeMatch)
+		}
+	}
+	return match
+}
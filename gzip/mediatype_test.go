@@ -0,0 +1,35 @@
+package gzip
+
+import (
+	"testing"
+)
+
+func Test_matchMediaType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		patterns    []string
+		want        int
+	}{
+		{"image/png", []string{"image/*"}, typeMatch},
+		{"image/png", []string{"text/*"}, noMatch},
+		{"image/png", []string{"image/"}, typeMatch},
+		{"image/png", []string{"*/*"}, anyMatch},
+		{"image/png", []string{"*/*", "image/*", "image/png"}, exactMatch},
+		{"image/png", []string{"image/png", "image/*"}, exactMatch},
+		{"Image/PNG; foo=bar", []string{"image/png"}, exactMatch},
+		{"text/html; charset=utf-8", []string{"TEXT/*"}, typeMatch},
+		{"text/html", []string{"text/plain"}, noMatch},
+		{"", []string{"*/*"}, noMatch},
+		{"image/png", nil, noMatch},
+		{"application/grpc+json", []string{"application/grpc"}, suffixMatch},
+		{"application/grpc+json", []string{"application/grpc", "application/grpc+json"}, exactMatch},
+		{"application/grpc-web+json", []string{"application/grpc"}, noMatch},
+		{"application/grpc", []string{"application/grpc+json"}, noMatch},
+	}
+
+	for _, test := range tests {
+		if got := matchMediaType(test.contentType, test.patterns); got != test.want {
+			t.Errorf("matchMediaType(%q, %q) = %d, want %d", test.contentType, test.patterns, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package gzip
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const encodingIdentity = "identity"
+
+// acceptEncoding maps the content codings listed in an Accept-Encoding header
+// to their qvalues.
+type acceptEncoding map[string]float64
+
+// parseAcceptEncoding parses an Accept-Encoding header value. Codings are
+// lower-cased and "x-gzip" is treated as "gzip". A missing qvalue means 1, a
+// malformed one 0. When a coding is listed more than once the first entry
+// wins.
+func parseAcceptEncoding(header string) acceptEncoding {
+	accepted := acceptEncoding{}
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		if coding == "x-gzip" {
+			coding = encodingGzip
+		}
+		if _, ok := accepted[coding]; ok {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(param, "=")
+			if !strings.EqualFold(strings.TrimSpace(name), "q") {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			// Written this way round so NaN is rejected as well.
+			if err != nil || !(parsed >= 0 && parsed <= 1) {
+				parsed = 0
+			}
+			q = parsed
+		}
+		accepted[coding] = q
+	}
+	return accepted
+}
+
+// qvalue returns the qvalue the client assigned to coding, falling back to the
+// "*" wildcard. The second result is false if neither was listed.
+func (a acceptEncoding) qvalue(coding string) (float64, bool) {
+	if q, ok := a[coding]; ok {
+		return q, true
+	}
+	q, ok := a["*"]
+	return q, ok
+}
+
+// acceptsIdentity reports whether the client accepts an uncompressed
+// response. That is the case unless identity, or the "*" wildcard without an
+// entry for identity, has a qvalue of 0.
+func (a acceptEncoding) acceptsIdentity() bool {
+	q, ok := a.qvalue(encodingIdentity)
+	return !ok || q > 0
+}
+
+// negotiate returns the handler encoding with the highest non-zero qvalue in
+// the request's Accept-Encoding header, or the handler's AcceptEncodingHeader.
+// Ties go to the handler's order of preference. It returns "identity" if the
+// client accepts none of them, or explicitly prefers identity over all of
+// them, and an empty string if the client doesn't accept an uncompressed
+// response either.
+func (h *handler) negotiate(r *http.Request) string {
+	// Without the header any encoding is acceptable, but compressing is not
+	// expected. This is the common case for clients that can't decompress,
+	// so it must not allocate.
+	values := r.Header.Values(h.acceptEncodingHeader())
+	if len(values) == 0 {
+		return encodingIdentity
+	}
+	accepted := parseAcceptEncoding(strings.Join(values, ","))
+
+	best, bestQ := "", 0.0
+	for _, encoding := range h.encodings {
+		if q, ok := accepted.qvalue(encoding); ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	if best == "" && accepted.acceptsIdentity() {
+		return encodingIdentity
+	}
+	// A tie with identity still compresses, only an explicitly higher
+	// qvalue for identity asks for an uncompressed response.
+	if q, ok := accepted[encodingIdentity]; ok && q > bestQ {
+		return encodingIdentity
+	}
+	return best
+}
@@ -0,0 +1,116 @@
+package gzip
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_negotiate(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		encodings      []string
+		want           string
+	}{
+		{"", []string{encodingGzip}, encodingIdentity},
+		{"gzip", []string{encodingGzip}, encodingGzip},
+		{"GZIP", []string{encodingGzip}, encodingGzip},
+		{"x-gzip", []string{encodingGzip}, encodingGzip},
+		{"deflate, gzip", []string{encodingGzip}, encodingGzip},
+		{"gzip;q=0", []string{encodingGzip}, encodingIdentity},
+		{"gzip; q=0.0", []string{encodingGzip}, encodingIdentity},
+		{"gzip;q=0.001", []string{encodingGzip}, encodingGzip},
+		{"gzip;q=abc", []string{encodingGzip}, encodingIdentity},
+		{"gzip;q=0, gzip", []string{encodingGzip}, encodingIdentity},
+		{"*", []string{encodingGzip}, encodingGzip},
+		{"*;q=0", []string{encodingGzip}, ""},
+		{"identity;q=0", []string{encodingGzip}, ""},
+		{"identity;q=0, *;q=0", []string{encodingGzip}, ""},
+		{"*;q=0, identity", []string{encodingGzip}, encodingIdentity},
+		{"gzip;q=0, identity;q=0", []string{encodingGzip}, ""},
+		{"*, gzip;q=0", []string{encodingGzip}, encodingIdentity},
+		{"gzip, br", []string{encodingBrotli, encodingGzip}, encodingBrotli},
+		{"gzip, br;q=0.5", []string{encodingBrotli, encodingGzip}, encodingGzip},
+		{"br;q=0", []string{encodingBrotli, encodingGzip}, encodingIdentity},
+		{"deflate", []string{encodingGzip, encodingDeflate}, encodingDeflate},
+		{"deflate, gzip", []string{encodingGzip, encodingDeflate}, encodingGzip},
+		{"deflate, gzip;q=0.5", []string{encodingGzip, encodingDeflate}, encodingDeflate},
+		{"identity", []string{encodingGzip}, encodingIdentity},
+		{"gzip, identity", []string{encodingGzip}, encodingGzip},
+		{"identity, gzip", []string{encodingGzip}, encodingGzip},
+		{"identity, gzip;q=0.5", []string{encodingGzip}, encodingIdentity},
+		{"identity;q=0.5, gzip", []string{encodingGzip}, encodingGzip},
+		{"gzip;q=0.5, identity;q=0.5", []string{encodingGzip}, encodingGzip},
+	}
+
+	for _, test := range tests {
+		h := NewWithEncodings(test.encodings, DefaultCompression)
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, test.acceptEncoding)
+
+		if got := h.negotiate(req); got != test.want {
+			t.Errorf("negotiate(%q) = %q, want %q", test.acceptEncoding, got, test.want)
+		}
+	}
+}
+
+func FuzzParseAcceptEncoding(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"gzip",
+		"gzip;q=",
+		"gzip;q=abc",
+		"gzip;q=1.5",
+		"gzip;q=-0",
+		"gzip;q=NaN",
+		"gzip;q=1e-400",
+		",,,",
+		";;;",
+		"=;=,=",
+		"gzip;;q=0.5;q=0.1",
+		" \t gzip \t ; \t q \t = \t 0.5 \t ",
+		"x-gzip, GZIP;q=0",
+		"*;q=0, identity;q=0",
+		"br;q=0.9, gzip;q=0.9, deflate;q=0.9, identity;q=0.9",
+		"\xff\xfe;q=\x00",
+		strings.Repeat("gzip;q=0.5,", 10000),
+		strings.Repeat(" ", 10000),
+	} {
+		f.Add(seed)
+	}
+
+	h := NewWithEncodings([]string{encodingBrotli, encodingGzip, encodingDeflate}, DefaultCompression)
+	f.Fuzz(func(t *testing.T, header string) {
+		accepted := parseAcceptEncoding(header)
+		for coding, q := range accepted {
+			if coding == "" || coding != strings.ToLower(coding) {
+				t.Errorf("parseAcceptEncoding(%q) returned coding %q", header, coding)
+			}
+			if !(q >= 0 && q <= 1) {
+				t.Errorf("parseAcceptEncoding(%q) returned qvalue %v for %q", header, q, coding)
+			}
+		}
+		if again := parseAcceptEncoding(header); !reflect.DeepEqual(accepted, again) {
+			t.Errorf("parseAcceptEncoding(%q) is not deterministic: %v, then %v", header, accepted, again)
+		}
+
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerAcceptEncoding, header)
+		encoding := h.negotiate(req)
+		switch encoding {
+		case "", encodingIdentity, encodingBrotli, encodingGzip, encodingDeflate:
+		default:
+			t.Errorf("negotiate(%q) = %q", header, encoding)
+		}
+		if again := h.negotiate(req); again != encoding {
+			t.Errorf("negotiate(%q) is not deterministic: %q, then %q", header, encoding, again)
+		}
+	})
+}
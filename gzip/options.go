@@ -0,0 +1,377 @@
+package gzip
+
+import (
+	"github.com/codegangsta/negroni"
+	"net/http"
+	"reflect"
+	"regexp"
+)
+
+// Option configures a handler created by NewWithOptions.
+type Option func(*handler)
+
+// NewWithOptions returns a handler configured by opts. Without options it
+// behaves like Default.
+func NewWithOptions(opts ...Option) *handler {
+	h := &handler{
+		compressionLevel: DefaultCompression,
+		encodings:        []string{encodingGzip},
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// WithLevel sets the compression level. Valid values are identical to those
+// in the compress/gzip package.
+func WithLevel(level int) Option {
+	return func(h *handler) {
+		h.compressionLevel = level
+	}
+}
+
+// WithAllowFunc sets the callback that enables or disables compression for a
+// response. See New.
+func WithAllowFunc(fn AllowCompressionFunc) Option {
+	return func(h *handler) {
+		h.allowCompression = fn.WithStatus()
+	}
+}
+
+// WithAllowFuncWithStatus is WithAllowFunc for a callback that is also passed
+// the status code of the response.
+func WithAllowFuncWithStatus(fn AllowCompressionFuncWithStatus) Option {
+	return func(h *handler) {
+		h.allowCompression = fn
+	}
+}
+
+// WithAllowFuncE sets an AllowCompressionFuncE, which is consulted after the
+// AllowCompressionFunc.
+func WithAllowFuncE(fn AllowCompressionFuncE) Option {
+	return func(h *handler) {
+		h.allowCompressionE = fn
+	}
+}
+
+// WithEncodings sets the encodings to negotiate, in order of preference. See
+// NewWithEncodings.
+func WithEncodings(encodings ...string) Option {
+	return func(h *handler) {
+		h.encodings = encodings
+	}
+}
+
+// WithMinSize sets MinSize.
+func WithMinSize(size int) Option {
+	return func(h *handler) {
+		h.MinSize = size
+	}
+}
+
+// WithExcludedTypes sets ExcludedContentTypes.
+func WithExcludedTypes(types []string) Option {
+	return func(h *handler) {
+		h.ExcludedContentTypes = types
+	}
+}
+
+// WithAdditionalExcludedTypes sets ExcludedContentTypes to
+// DefaultExcludedContentTypes followed by types.
+func WithAdditionalExcludedTypes(types ...string) Option {
+	return func(h *handler) {
+		excluded := make([]string, 0, len(DefaultExcludedContentTypes)+len(types))
+		excluded = append(excluded, DefaultExcludedContentTypes...)
+		h.ExcludedContentTypes = append(excluded, types...)
+	}
+}
+
+// WithCompressibleTypes sets CompressibleTypes.
+func WithCompressibleTypes(types []string) Option {
+	return func(h *handler) {
+		h.CompressibleTypes = types
+	}
+}
+
+// WithOnError sets OnError.
+func WithOnError(fn func(error)) Option {
+	return func(h *handler) {
+		h.OnError = fn
+	}
+}
+
+// WithOnComplete sets OnComplete.
+func WithOnComplete(fn func(Stats)) Option {
+	return func(h *handler) {
+		h.OnComplete = fn
+	}
+}
+
+// WithLabel sets Label.
+func WithLabel(label string) Option {
+	return func(h *handler) {
+		h.Label = label
+	}
+}
+
+// WithOnSkip sets OnSkip.
+func WithOnSkip(fn func(r *http.Request, reason string)) Option {
+	return func(h *handler) {
+		h.OnSkip = fn
+	}
+}
+
+// WithDebugHeaders sets DebugHeaders.
+func WithDebugHeaders(debug bool) Option {
+	return func(h *handler) {
+		h.DebugHeaders = debug
+	}
+}
+
+// WithOnEnable sets OnEnable.
+func WithOnEnable(fn func(r *http.Request, encoding string)) Option {
+	return func(h *handler) {
+		h.OnEnable = fn
+	}
+}
+
+// WithCacheableOnly sets CacheableOnly.
+func WithCacheableOnly(cacheableOnly bool) Option {
+	return func(h *handler) {
+		h.CacheableOnly = cacheableOnly
+	}
+}
+
+// WithSkipTransferEncoding sets SkipTransferEncoding.
+func WithSkipTransferEncoding(skip bool) Option {
+	return func(h *handler) {
+		h.SkipTransferEncoding = skip
+	}
+}
+
+// WithExcludedPaths sets ExcludedPaths.
+func WithExcludedPaths(prefixes ...string) Option {
+	return func(h *handler) {
+		h.ExcludedPaths = prefixes
+	}
+}
+
+// WithExcludedPathRegexps sets ExcludedPathRegexps.
+func WithExcludedPathRegexps(res ...*regexp.Regexp) Option {
+	return func(h *handler) {
+		h.ExcludedPathRegexps = res
+	}
+}
+
+// WithAutoFlush sets AutoFlush.
+func WithAutoFlush(autoFlush bool) Option {
+	return func(h *handler) {
+		h.AutoFlush = autoFlush
+	}
+}
+
+// WithFlushThreshold sets FlushThreshold.
+func WithFlushThreshold(n int) Option {
+	return func(h *handler) {
+		h.FlushThreshold = n
+	}
+}
+
+// WithCompressEventStreams sets CompressEventStreams.
+func WithCompressEventStreams(compress bool) Option {
+	return func(h *handler) {
+		h.CompressEventStreams = compress
+	}
+}
+
+// WithWriterFactory sets WriterFactory.
+func WithWriterFactory(factory WriterFactory) Option {
+	return func(h *handler) {
+		h.WriterFactory = factory
+	}
+}
+
+// WithStrictNegotiation sets StrictNegotiation.
+func WithStrictNegotiation(strict bool) Option {
+	return func(h *handler) {
+		h.StrictNegotiation = strict
+	}
+}
+
+// WithAcceptEncodingHeader sets AcceptEncodingHeader.
+func WithAcceptEncodingHeader(name string) Option {
+	return func(h *handler) {
+		h.AcceptEncodingHeader = name
+	}
+}
+
+// WithLevelFunc sets LevelFunc.
+func WithLevelFunc(fn func(w http.ResponseWriter, r *http.Request) int) Option {
+	return func(h *handler) {
+		h.LevelFunc = fn
+	}
+}
+
+// WithStripAcceptRanges sets StripAcceptRanges.
+func WithStripAcceptRanges(strip bool) Option {
+	return func(h *handler) {
+		h.StripAcceptRanges = strip
+	}
+}
+
+// Middleware is like NewWithOptions, but returns the handler as a
+// negroni.Handler, so it can be kept in a field or variable of that type.
+func Middleware(opts ...Option) negroni.Handler {
+	return NewWithOptions(opts...)
+}
+
+// WithForce sets Force.
+func WithForce(force bool) Option {
+	return func(h *handler) {
+		h.Force = force
+	}
+}
+
+// WithBuggyClientFunc sets BuggyClientFunc.
+func WithBuggyClientFunc(fn BuggyClientFunc) Option {
+	return func(h *handler) {
+		h.BuggyClientFunc = fn
+	}
+}
+
+// WithNoVary sets NoVary.
+func WithNoVary(noVary bool) Option {
+	return func(h *handler) {
+		h.NoVary = noVary
+	}
+}
+
+// WithVaryHeaders sets VaryHeaders.
+func WithVaryHeaders(names ...string) Option {
+	return func(h *handler) {
+		h.VaryHeaders = names
+	}
+}
+
+// WithThreadSafe sets ThreadSafe.
+func WithThreadSafe(threadSafe bool) Option {
+	return func(h *handler) {
+		h.ThreadSafe = threadSafe
+	}
+}
+
+// WithMaxBytes sets MaxBytes.
+func WithMaxBytes(n int64) Option {
+	return func(h *handler) {
+		h.MaxBytes = n
+	}
+}
+
+// WithDetectContentType sets DetectContentType.
+func WithDetectContentType(fn func(b []byte) string) Option {
+	return func(h *handler) {
+		h.DetectContentType = fn
+	}
+}
+
+// WithAlwaysDetectContentType sets AlwaysDetectContentType.
+func WithAlwaysDetectContentType(detect bool) Option {
+	return func(h *handler) {
+		h.AlwaysDetectContentType = detect
+	}
+}
+
+// WithSniffCompressibility sets SniffCompressibility.
+func WithSniffCompressibility(sniff bool) Option {
+	return func(h *handler) {
+		h.SniffCompressibility = sniff
+	}
+}
+
+// WithBufferCompressed sets BufferCompressed.
+func WithBufferCompressed(buffer bool) Option {
+	return func(h *handler) {
+		h.BufferCompressed = buffer
+	}
+}
+
+// WithBufferCompressedSize sets BufferCompressedSize.
+func WithBufferCompressedSize(size int) Option {
+	return func(h *handler) {
+		h.BufferCompressedSize = size
+	}
+}
+
+// WithCoalesceWrites sets CoalesceWrites.
+func WithCoalesceWrites(coalesce bool) Option {
+	return func(h *handler) {
+		h.CoalesceWrites = coalesce
+	}
+}
+
+// WithCoalesceSize sets CoalesceSize.
+func WithCoalesceSize(size int) Option {
+	return func(h *handler) {
+		h.CoalesceSize = size
+	}
+}
+
+// WithOnly2xx sets a ShouldCompressStatus that restricts compression to
+// successful responses, leaving redirects and error pages uncompressed. With
+// false, a ShouldCompressStatus set by an earlier WithOnly2xx is reset to the
+// default, while one set otherwise is kept.
+func WithOnly2xx(only bool) Option {
+	return func(h *handler) {
+		switch {
+		case only:
+			h.ShouldCompressStatus = only2xx
+		case h.ShouldCompressStatus != nil &&
+			reflect.ValueOf(h.ShouldCompressStatus).Pointer() == reflect.ValueOf(only2xx).Pointer():
+			h.ShouldCompressStatus = nil
+		}
+	}
+}
+
+// WithShouldCompressStatus sets ShouldCompressStatus.
+func WithShouldCompressStatus(fn func(code int) bool) Option {
+	return func(h *handler) {
+		h.ShouldCompressStatus = fn
+	}
+}
+
+// WithResetOnRewrite sets ResetOnRewrite.
+func WithResetOnRewrite(reset bool) Option {
+	return func(h *handler) {
+		h.ResetOnRewrite = reset
+	}
+}
+
+// WithAlwaysVary sets AlwaysVary.
+func WithAlwaysVary(always bool) Option {
+	return func(h *handler) {
+		h.AlwaysVary = always
+	}
+}
+
+// WithSkipMethods sets SkipMethods.
+func WithSkipMethods(methods ...string) Option {
+	return func(h *handler) {
+		h.SkipMethods = methods
+	}
+}
+
+// WithDisableHeader sets DisableHeader and DisableHeaderValue.
+func WithDisableHeader(name, value string) Option {
+	return func(h *handler) {
+		h.DisableHeader = name
+		h.DisableHeaderValue = value
+	}
+}
+
+// WithPeekFirstWrite sets PeekFirstWrite.
+func WithPeekFirstWrite(peek bool) Option {
+	return func(h *handler) {
+		h.PeekFirstWrite = peek
+	}
+}
@@ -0,0 +1,105 @@
+package gzip
+
+import (
+	"github.com/codegangsta/negroni"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func Test_NewWithOptions_Defaults(t *testing.T) {
+	h := NewWithOptions()
+
+	if h.compressionLevel != DefaultCompression {
+		t.Fail()
+	}
+	if !reflect.DeepEqual(h.encodings, []string{encodingGzip}) {
+		t.Fail()
+	}
+	if h.allowCompression != nil || h.MinSize != 0 || h.ExcludedContentTypes != nil {
+		t.Fail()
+	}
+}
+
+func Test_NewWithOptions(t *testing.T) {
+	allow := func(w http.ResponseWriter, r *http.Request) bool {
+		return false
+	}
+	h := NewWithOptions(
+		WithLevel(BestSpeed),
+		WithAllowFunc(allow),
+		WithEncodings(encodingBrotli, encodingGzip),
+		WithMinSize(256),
+		WithExcludedTypes([]string{"application/pdf"}),
+		WithCompressibleTypes([]string{"text/html"}),
+	)
+
+	if h.compressionLevel != BestSpeed {
+		t.Fail()
+	}
+	if h.allowCompression == nil || h.allowCompression(httptest.NewRecorder(), nil, http.StatusOK) {
+		t.Fail()
+	}
+	if !reflect.DeepEqual(h.encodings, []string{encodingBrotli, encodingGzip}) {
+		t.Fail()
+	}
+	if h.MinSize != 256 {
+		t.Fail()
+	}
+	if !reflect.DeepEqual(h.ExcludedContentTypes, []string{"application/pdf"}) {
+		t.Fail()
+	}
+	if !reflect.DeepEqual(h.CompressibleTypes, []string{"text/html"}) {
+		t.Fail()
+	}
+}
+
+func Test_Middleware(t *testing.T) {
+	var middleware negroni.Handler = Middleware(WithLevel(BestSpeed))
+
+	n := negroni.New(middleware)
+	n.UseHandler(http.HandlerFunc(testHTTPContent))
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAcceptEncoding, encodingGzip)
+
+	n.ServeHTTP(w, req)
+
+	if w.Header().Get(headerContentEncoding) != encodingGzip {
+		t.Fail()
+	}
+}
+
+func Test_WithAdditionalExcludedTypes(t *testing.T) {
+	defaults := append([]string(nil), DefaultExcludedContentTypes...)
+	h := NewWithOptions(WithAdditionalExcludedTypes("application/pdf"))
+
+	want := append(append([]string(nil), defaults...), "application/pdf")
+	if !reflect.DeepEqual(h.ExcludedContentTypes, want) {
+		t.Errorf("ExcludedContentTypes = %v, want %v", h.ExcludedContentTypes, want)
+	}
+	if !reflect.DeepEqual(DefaultExcludedContentTypes, defaults) {
+		t.Errorf("DefaultExcludedContentTypes was modified: %v", DefaultExcludedContentTypes)
+	}
+}
+
+func Test_WithOnly2xx(t *testing.T) {
+	only404 := func(code int) bool {
+		return code == http.StatusNotFound
+	}
+
+	h := NewWithOptions(WithOnly2xx(true), WithOnly2xx(false))
+	if h.ShouldCompressStatus != nil {
+		t.Error("WithOnly2xx(false) kept its own ShouldCompressStatus")
+	}
+
+	h = NewWithOptions(WithShouldCompressStatus(only404), WithOnly2xx(false))
+	if h.ShouldCompressStatus == nil || !h.ShouldCompressStatus(http.StatusNotFound) {
+		t.Error("WithOnly2xx(false) dropped the ShouldCompressStatus set before it")
+	}
+}
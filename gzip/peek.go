@@ -0,0 +1,47 @@
+package gzip
+
+// peekWriter holds the start of a body while the compression decision is
+// pending, until enough of it was seen to decide. The buffer is taken from
+// the handler's pool on the first write and returned with release.
+type peekWriter struct {
+	buf    []byte
+	bufp   *[]byte
+	writes int
+}
+
+// write appends b to the held body.
+func (p *peekWriter) write(h *handler, b []byte) {
+	if p.bufp == nil {
+		p.bufp = h.getBuffer()
+		p.buf = (*p.bufp)[:0]
+	}
+	p.buf = append(p.buf, b...)
+	p.writes++
+}
+
+// len returns the number of bytes held.
+func (p *peekWriter) len() int {
+	return len(p.buf)
+}
+
+// take returns the held body and stops holding it. The bytes stay valid
+// until release.
+func (p *peekWriter) take() []byte {
+	buf := p.buf
+	p.buf = nil
+	return buf
+}
+
+// reset discards the held body.
+func (p *peekWriter) reset() {
+	p.buf = p.buf[:0]
+	p.writes = 0
+}
+
+// release returns the buffer to the pool of h.
+func (p *peekWriter) release(h *handler) {
+	if p.bufp != nil {
+		h.buffers.Put(p.bufp)
+	}
+	*p = peekWriter{}
+}
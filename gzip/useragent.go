@@ -0,0 +1,31 @@
+package gzip
+
+import (
+	"net/http"
+	"strings"
+)
+
+// BuggyClientFunc reports whether the client that sent r advertises gzip
+// support but can't handle compressed responses.
+type BuggyClientFunc func(r *http.Request) bool
+
+// DefaultBuggyClient is the BuggyClientFunc used when none is configured. It
+// matches the clients web servers traditionally leave uncompressed:
+//
+//   - Netscape 4.06 to 4.08, which can't decompress at all.
+//   - Internet Explorer 4 to 6 without the fixes of Windows XP SP2, which
+//     mark themselves with "SV1".
+func DefaultBuggyClient(r *http.Request) bool {
+	ua := r.UserAgent()
+	if strings.Contains(ua, "MSIE ") {
+		if strings.Contains(ua, "SV1") {
+			return false
+		}
+		return strings.Contains(ua, "MSIE 4.") ||
+			strings.Contains(ua, "MSIE 5.") ||
+			strings.Contains(ua, "MSIE 6.")
+	}
+	return strings.HasPrefix(ua, "Mozilla/4.06") ||
+		strings.HasPrefix(ua, "Mozilla/4.07") ||
+		strings.HasPrefix(ua, "Mozilla/4.08")
+}
@@ -0,0 +1,31 @@
+package gzip
+
+import (
+	"net/http"
+	"testing"
+)
+
+func Test_DefaultBuggyClient(t *testing.T) {
+	tests := map[string]bool{
+		"Mozilla/4.08 [en] (Win98; U)":                                           true,
+		"Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.1)":                     true,
+		"Mozilla/4.0 (compatible; MSIE 5.5; Windows 98)":                         true,
+		"Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.1; SV1)":                false,
+		"Mozilla/4.0 (compatible; MSIE 7.0; Windows NT 6.0)":                     false,
+		"Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0": false,
+		"curl/8.5.0": false,
+		"":           false,
+	}
+
+	for ua, want := range tests {
+		req, err := http.NewRequest("GET", "http://localhost/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("User-Agent", ua)
+
+		if got := DefaultBuggyClient(req); got != want {
+			t.Errorf("DefaultBuggyClient(%q) = %v, want %v", ua, got, want)
+		}
+	}
+}